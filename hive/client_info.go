@@ -0,0 +1,119 @@
+package hive2
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/apache/thrift/lib/go/thrift"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// ApplicationNameKey is the client info key of the application name, as Hive JDBC sends
+// it. The applicationName connection parameter sets it on every connection.
+const ApplicationNameKey = "ApplicationName"
+
+// queryTagConf and sessionIDConf label the sessions of the applicationName parameter
+// on every server, and keep the application name on servers without SetClientInfo. Hive
+// shows the tag of each query, and KILL QUERY accepts it.
+const (
+	queryTagConf  = "hive.query.tag"
+	sessionIDConf = "hive.session.id"
+)
+
+// sessionLabels returns the settings of the OpenSession request labelling the session
+// with the application name: the query tag, and a session id made of the name and a
+// random suffix, since the server names scratch directories after it.
+func sessionLabels(name string) (map[string]string, error) {
+	suffix := make([]byte, 16)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	prefix := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	return map[string]string{
+		"set:hiveconf:" + queryTagConf:  name,
+		"set:hiveconf:" + sessionIDConf: prefix + "_" + hex.EncodeToString(suffix),
+	}, nil
+}
+
+// SetClientInfo labels the session of conn with info, which HiveServer2 shows in its logs
+// and web UI, so that a query can be traced back to the service that ran it. The labels
+// are merged with those set before, and are kept when the session is reopened.
+//
+// Servers older than Hive 4 have no SetClientInfo; on them only ApplicationNameKey is
+// kept, as the hive.query.tag setting of the session, and must not contain semicolons,
+// control characters or ${.
+func SetClientInfo(ctx context.Context, conn *sql.Conn, info map[string]string) error {
+	return withHiveConn(conn, func(hc *hiveConn) error {
+		if hc.clientInfo == nil {
+			hc.clientInfo = map[string]string{}
+		}
+		for k, v := range info {
+			hc.clientInfo[k] = v
+		}
+		return hc.sendClientInfo(ctx, info)
+	})
+}
+
+// setClientInfo sends info to the server with SetClientInfo, reporting false when the
+// server does not support it.
+func (hc *hiveConn) setClientInfo(ctx context.Context, info map[string]string) (bool, error) {
+	if len(info) == 0 {
+		return true, nil
+	}
+	if !hc.supports(featureClientInfo) || hc.noClientInfo {
+		return false, nil
+	}
+	req := tcliservice.NewTSetClientInfoReq()
+	req.SessionHandle = hc.sessHandle
+	req.Configuration = info
+	resp, err := hc.client.SetClientInfo(ctx, req)
+	var appErr thrift.TApplicationException
+	if err == nil {
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return false, hc.serverError(resp.GetStatus())
+		}
+		return true, nil
+	}
+	// Servers before Hive 4 speak V11 too, but answer with an unknown method exception.
+	if !errors.As(err, &appErr) || appErr.TypeId() != thrift.UNKNOWN_METHOD {
+		hc.checkError(err)
+		return false, err
+	}
+	hc.noClientInfo = true
+	return false, nil
+}
+
+// sendClientInfo sends info with SetClientInfo, or falls back to setting the application
+// name as the query tag when the server does not support it.
+func (hc *hiveConn) sendClientInfo(ctx context.Context, info map[string]string) error {
+	sent, err := hc.setClientInfo(ctx, info)
+	if sent || err != nil {
+		return err
+	}
+	name, ok := info[ApplicationNameKey]
+	if !ok {
+		return nil
+	}
+	// SET takes its value verbatim up to the end of the statement.
+	if strings.Contains(name, ";") || strings.Contains(name, "${") || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("hive2: application name %q cannot be set as %s: it contains ;, ${ or a control character", name, queryTagConf)
+	}
+	stmt := &hiveStmt{hc: hc, sql: "set " + queryTagConf + "=" + name, untracked: true}
+	_, err = stmt.exec(ctx)
+	if closeErr := stmt.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
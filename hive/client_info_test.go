@@ -0,0 +1,148 @@
+package hive2
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+func TestApplicationName(t *testing.T) {
+	tests := []struct {
+		name       string
+		protocol   tcliservice.TProtocolVersion
+		missing    []string
+		clientInfo int
+		executed   []string
+	}{
+		{"SetClientInfo", tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11, nil, 1, nil},
+		{"unknown method", tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11, []string{"SetClientInfo"}, 0, nil},
+		{"older protocol", tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V10, nil, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hive := newFakeHive()
+			hive.protocol = tt.protocol
+			hive.missing = tt.missing
+			db := openFakeDB(t, startFakeServer(t, hive), ";applicationName=etl")
+			if err := db.Ping(); err != nil {
+				t.Fatal(err)
+			}
+			hive.mu.Lock()
+			clientInfo := hive.clientInfo
+			hive.mu.Unlock()
+			if len(clientInfo) != tt.clientInfo {
+				t.Fatalf("SetClientInfo called %d times, want %d", len(clientInfo), tt.clientInfo)
+			}
+			if len(clientInfo) > 0 && clientInfo[0][ApplicationNameKey] != "etl" {
+				t.Errorf("client info %v", clientInfo[0])
+			}
+			if executed := hive.executed(); !reflect.DeepEqual(executed, tt.executed) {
+				t.Errorf("executed %q, want %q", executed, tt.executed)
+			}
+			// Every server gets the name as the query tag and session id of the session.
+			hive.mu.Lock()
+			conf := hive.openReqs[0].GetConfiguration()
+			hive.mu.Unlock()
+			if conf["set:hiveconf:hive.query.tag"] != "etl" || !strings.HasPrefix(conf["set:hiveconf:hive.session.id"], "etl_") {
+				t.Errorf("OpenSession configuration %v", conf)
+			}
+		})
+	}
+}
+
+func TestSessionLabels(t *testing.T) {
+	first, err := sessionLabels("nightly report; v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sessionLabels("nightly report; v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first["set:hiveconf:hive.query.tag"] != "nightly report; v2" {
+		t.Errorf("query tag %q", first["set:hiveconf:hive.query.tag"])
+	}
+	id := first["set:hiveconf:hive.session.id"]
+	if !strings.HasPrefix(id, "nightly_report__v2_") || id == second["set:hiveconf:hive.session.id"] {
+		t.Errorf("session ids %q and %q", id, second["set:hiveconf:hive.session.id"])
+	}
+}
+
+func TestSetClientInfo(t *testing.T) {
+	hive := newFakeHive()
+	hive.protocol = tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11
+	db := openFakeDB(t, startFakeServer(t, hive), ";applicationName=etl;reopenExpiredSession=true")
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SetClientInfo(ctx, conn, map[string]string{"team": "dba"}); err != nil {
+		t.Fatal(err)
+	}
+	// The reopened session gets all of the client info.
+	hive.expireSessions()
+	if _, err := conn.ExecContext(ctx, "insert into t values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	want := []map[string]string{
+		{ApplicationNameKey: "etl"},
+		{"team": "dba"},
+		{ApplicationNameKey: "etl", "team": "dba"},
+	}
+	if !reflect.DeepEqual(hive.clientInfo, want) {
+		t.Errorf("client info %v, want %v", hive.clientInfo, want)
+	}
+}
+
+func TestSetClientInfoOlderServer(t *testing.T) {
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SetClientInfo(ctx, conn, map[string]string{"team": "dba"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetClientInfo(ctx, conn, map[string]string{ApplicationNameKey: "report job"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etl; drop table t", "etl\nset x=1", "${env:HOME}"} {
+		if err := SetClientInfo(ctx, conn, map[string]string{ApplicationNameKey: name}); err == nil {
+			t.Errorf("SetClientInfo(%q) should fail on a server without SetClientInfo", name)
+		}
+	}
+	want := "set hive.query.tag=report job"
+	if executed := hive.executed(); strings.Join(executed, ";") != want {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+}
+
+func TestSetClientInfoOlderServerCancelled(t *testing.T) {
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The query tag is set with the caller's context.
+	err = SetClientInfo(ctx, conn, map[string]string{ApplicationNameKey: "etl"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("SetClientInfo with a cancelled context returned %v", err)
+	}
+}
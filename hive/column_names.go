@@ -0,0 +1,71 @@
+package hive2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// uniqueColumnNamesConf makes HiveServer2 prefix column names with their table, as in
+// t.id, when true, its default.
+const uniqueColumnNamesConf = "hive.resultset.use.unique.column.names"
+
+// WithStripColumnPrefix removes the table prefix from the column names of result sets, so
+// that t.id becomes id, except where it would leave two columns with the same name. It
+// overrides the stripColumnPrefix connection parameter.
+func WithStripColumnPrefix(strip bool) ConnectorOption {
+	return func(c *connector) {
+		c.stripPrefix = &strip
+	}
+}
+
+// WithUniqueColumnNames sets hive.resultset.use.unique.column.names in new sessions; false
+// makes the server name columns without their table, as the JDBC driver lets it. It
+// overrides the uniqueColumnNames connection parameter.
+func WithUniqueColumnNames(unique bool) ConnectorOption {
+	return func(c *connector) {
+		c.uniqueNames = &unique
+	}
+}
+
+// columnNameOptions returns whether to strip the table prefix from column names, and the
+// value of hive.resultset.use.unique.column.names for new sessions, empty to leave it.
+func (c *connector) columnNameOptions() (strip bool, unique string, err error) {
+	if c.stripPrefix != nil {
+		strip = *c.stripPrefix
+	} else if value, ok := c.params.SessionVar["stripColumnPrefix"]; ok {
+		if strip, err = strconv.ParseBool(value); err != nil {
+			return false, "", fmt.Errorf("invalid stripColumnPrefix %q: must be true or false", value)
+		}
+	}
+	if c.uniqueNames != nil {
+		unique = strconv.FormatBool(*c.uniqueNames)
+	} else if value, ok := c.params.SessionVar["uniqueColumnNames"]; ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid uniqueColumnNames %q: must be true or false", value)
+		}
+		unique = strconv.FormatBool(b)
+	}
+	return strip, unique, nil
+}
+
+// stripColumnPrefixes returns names without the table prefix, keeping it on the names
+// that would otherwise collide.
+func stripColumnPrefixes(names []string) []string {
+	stripped := make([]string, len(names))
+	count := map[string]int{}
+	for i, name := range names {
+		stripped[i] = name
+		if dot := strings.LastIndex(name, "."); dot >= 0 {
+			stripped[i] = name[dot+1:]
+		}
+		count[strings.ToLower(stripped[i])]++
+	}
+	for i, name := range names {
+		if count[strings.ToLower(stripped[i])] > 1 {
+			stripped[i] = name
+		}
+	}
+	return stripped
+}
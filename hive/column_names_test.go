@@ -0,0 +1,87 @@
+package hive2
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripColumnPrefixes(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"t.id", "t.name", "_c2"}, []string{"id", "name", "_c2"}},
+		{[]string{"a.id", "b.ID", "b.name"}, []string{"a.id", "b.ID", "name"}},
+		{[]string{"id", "t.id"}, []string{"id", "t.id"}},
+	}
+	for _, tt := range tests {
+		if got := stripColumnPrefixes(tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stripColumnPrefixes(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestStripColumnPrefixParam(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	hive.setResult("select * from a join b", &fakeResult{columns: []string{"a.id", "b.id", "b.name"}})
+	for _, tt := range []struct {
+		params string
+		want   []string
+	}{
+		{"", []string{"a.id", "b.id", "b.name"}},
+		{";stripColumnPrefix=true", []string{"a.id", "b.id", "name"}},
+	} {
+		rows, err := openFakeDB(t, server, tt.params).Query("select * from a join b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns, _ := rows.Columns()
+		rows.Close()
+		if !reflect.DeepEqual(columns, tt.want) {
+			t.Errorf("%q: columns %q, want %q", tt.params, columns, tt.want)
+		}
+	}
+}
+
+func TestUniqueColumnNames(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	tests := []struct {
+		params string
+		opts   []ConnectorOption
+		want   string
+	}{
+		{"", nil, ""},
+		{";uniqueColumnNames=false", nil, "false"},
+		{";uniqueColumnNames=false", []ConnectorOption{WithUniqueColumnNames(true)}, "true"},
+		{"?hive.resultset.use.unique.column.names=true", []ConnectorOption{WithUniqueColumnNames(false), WithStripColumnPrefix(true)}, "false"},
+	}
+	for i, tt := range tests {
+		p, err := ParseUrl("hive2://" + server.addr() + "/default;auth=noSasl" + tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := sql.OpenDB(NewConnector(p, tt.opts...))
+		if err := db.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		hive.mu.Lock()
+		got := hive.openReqs[i].GetConfiguration()["set:hiveconf:hive.resultset.use.unique.column.names"]
+		hive.mu.Unlock()
+		if got != tt.want {
+			t.Errorf("%q: %s = %q, want %q", tt.params, uniqueColumnNamesConf, got, tt.want)
+		}
+	}
+
+	for _, params := range []string{";stripColumnPrefix=yes", ";uniqueColumnNames=no"} {
+		p, _ := ParseUrl("hive2://" + server.addr() + "/default;auth=noSasl" + params)
+		if _, err := NewConnector(p).Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%s: expected an error, got %v", params, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package hive2
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+type confKey struct{}
+
+// WithConf returns a context that applies conf to the statements run with it, through
+// the confOverlay of ExecuteStatement. Unlike a SET statement, the settings do not outlive
+// the statement, so they cannot leak to later users of a pooled session:
+//
+//	ctx = hive2.WithConf(ctx, map[string]string{"hive.execution.engine": "tez"})
+//	rows, err := db.QueryContext(ctx, query)
+//
+// Settings given to an outer WithConf are kept unless conf overrides them.
+func WithConf(ctx context.Context, conf map[string]string) context.Context {
+	merged := map[string]string{}
+	for k, v := range confFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range conf {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, confKey{}, merged)
+}
+
+// WithQueryTag returns a context that tags the statements run with it, for workload
+// management rules and KILL QUERY. It is the hive.query.tag setting of WithConf.
+func WithQueryTag(ctx context.Context, tag string) context.Context {
+	return WithConf(ctx, map[string]string{queryTagConf: tag})
+}
+
+// confFromContext returns the settings of WithConf, nil if there are none.
+func confFromContext(ctx context.Context) map[string]string {
+	conf, _ := ctx.Value(confKey{}).(map[string]string)
+	return conf
+}
+
+// ExecContext runs the statement with the settings of WithConf in ctx. The statement is
+// cancelled when ctx is done before it finishes.
+func (hs *hiveStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	hs.conf = confFromContext(ctx)
+	defer func() { hs.conf = nil }()
+	return hs.exec(ctx)
+}
+
+// QueryContext runs the statement with the settings of WithConf in ctx, or fetches the
+// results of the statement of WithOperation.
+func (hs *hiveStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if handle, ok := ctx.Value(operationKey{}).(*OperationHandle); ok {
+		return hs.attachOperation(ctx, handle)
+	}
+	hs.conf = confFromContext(ctx)
+	defer func() { hs.conf = nil }()
+	return hs.query(ctx)
+}
+
+var (
+	_ driver.StmtExecContext  = (*hiveStmt)(nil)
+	_ driver.StmtQueryContext = (*hiveStmt)(nil)
+)
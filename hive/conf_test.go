@@ -0,0 +1,42 @@
+package hive2
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestWithConf(t *testing.T) {
+	hive := newFakeHive()
+	hive.setResult("select 1", &fakeResult{columns: []string{"_c0"}, rows: [][]string{{"1"}}})
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	db.SetMaxOpenConns(1)
+
+	ctx := WithConf(context.Background(), map[string]string{"hive.execution.engine": "tez", "mapreduce.job.queuename": "etl"})
+	ctx = WithQueryTag(WithConf(ctx, map[string]string{"hive.execution.engine": "mr"}), "nightly")
+	if _, err := db.ExecContext(ctx, "insert into t values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryContext(WithQueryTag(context.Background(), "report"), "select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	// The settings do not stay with the pooled session.
+	if _, err := db.Exec("insert into t values (2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	want := []map[string]string{
+		{"hive.execution.engine": "mr", "mapreduce.job.queuename": "etl", "hive.query.tag": "nightly"},
+		{"hive.query.tag": "report"},
+		nil,
+	}
+	if !reflect.DeepEqual(hive.overlays, want) {
+		t.Errorf("overlays %v, want %v", hive.overlays, want)
+	}
+}
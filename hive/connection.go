@@ -5,6 +5,7 @@ import (
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/apache/thrift/lib/go/thrift"
 
@@ -16,9 +17,147 @@ type hiveConn struct {
 	client     *tcliservice.TCLIServiceClient
 	sessHandle *tcliservice.TSessionHandle
 	protocol   tcliservice.TProtocolVersion
-	ctx        context.Context
 	fetchSize  int64
 	params     *ConnParams
+	// runAsync is false when the runAsync parameter asks the server to run statements
+	// before answering ExecuteStatement.
+	runAsync bool
+	// openSession opens another session on the transport of the connection.
+	openSession func(ctx context.Context) (*tcliservice.TOpenSessionResp, error)
+
+	// bad is set once the transport failed or the server lost the session; database/sql
+	// then discards the connection instead of reusing it.
+	bad bool
+	// reopen opens a new session with the settings of the connection when
+	// reopenExpiredSession is set; expired is then set instead of bad until it has.
+	reopen  func(ctx context.Context) (*tcliservice.TOpenSessionResp, error)
+	expired bool
+	// progress receives the progress of running statements, see WithProgress.
+	progress func(Progress)
+	// clientInfo labels the session, see SetClientInfo; noClientInfo is set once the
+	// server turned out not to support SetClientInfo.
+	clientInfo   map[string]string
+	noClientInfo bool
+	// session records the changes statements made to the session, which sessionReset
+	// deals with before the connection is reused.
+	session      sessionState
+	sessionReset SessionReset
+	// vars are the variables of SetVariables and the connection parameters, substituted
+	// in statements when substitute is set.
+	vars       *Variables
+	substitute bool
+	// stripPrefix removes the table prefix from column names, see WithStripColumnPrefix.
+	stripPrefix bool
+}
+
+// invalidSessionMessage is how HiveServer2 reports a session it no longer knows, because
+// it restarted or the session timed out.
+const invalidSessionMessage = "Invalid SessionHandle"
+
+// checkError marks the connection bad when an RPC failed other than with an exception
+// raised by the server, since the transport is then in an unknown state.
+func (hc *hiveConn) checkError(err error) {
+	var appErr thrift.TApplicationException
+	if err != nil && !errors.As(err, &appErr) {
+		hc.bad = true
+	}
+}
+
+// serverError returns the error of a failed RPC. When the server lost the session, the
+// connection is marked bad, or expired if the session can be reopened.
+func (hc *hiveConn) serverError(status *tcliservice.TStatus) error {
+	if strings.Contains(status.GetErrorMessage(), invalidSessionMessage) {
+		if hc.reopen != nil {
+			hc.expired = true
+		} else {
+			hc.bad = true
+		}
+	}
+	return fmt.Errorf("Error from server: %s ", status.String())
+}
+
+// ensureSession reopens an expired session. The new session gets the database, HiveConf,
+// HiveVar and client info of the connection, but not what SET or USE statements changed
+// in the old one. The connection is bad if the session cannot be reopened.
+func (hc *hiveConn) ensureSession(ctx context.Context) error {
+	if !hc.expired {
+		return nil
+	}
+	openResp, err := hc.reopen(ctx)
+	if err != nil {
+		hc.bad = true
+		return err
+	}
+	hc.sessHandle = openResp.SessionHandle
+	hc.protocol = negotiatedProtocol(openResp.ServerProtocolVersion)
+	hc.expired = false
+	hc.session = sessionState{}
+	if err := hc.sendClientInfo(ctx, hc.clientInfo); err != nil {
+		hc.bad = true
+		return err
+	}
+	return nil
+}
+
+// Ping checks the session with a GetInfo call, returning driver.ErrBadConn when the
+// server cannot be reached or no longer knows the session.
+func (hc *hiveConn) Ping(ctx context.Context) error {
+	if hc.bad || hc.ensureSession(ctx) != nil {
+		return driver.ErrBadConn
+	}
+	infoReq := tcliservice.NewTGetInfoReq()
+	infoReq.SessionHandle = hc.sessHandle
+	infoReq.InfoType = tcliservice.TGetInfoType_CLI_SERVER_NAME
+	stop := closeOnCancel(ctx, hc.transport)
+	infoResp, err := hc.client.GetInfo(ctx, infoReq)
+	if cancelErr := stop(); cancelErr != nil {
+		hc.bad = true
+		return cancelErr
+	}
+	if err != nil {
+		hc.checkError(err)
+		if hc.bad {
+			return driver.ErrBadConn
+		}
+		return err
+	}
+	if !verifySuccessWithInfo(infoResp.GetStatus()) {
+		err := hc.serverError(infoResp.GetStatus())
+		if hc.expired {
+			err = hc.ensureSession(ctx)
+		}
+		if hc.bad {
+			return driver.ErrBadConn
+		}
+		return err
+	}
+	return nil
+}
+
+// ResetSession is called before the connection is reused; it refuses bad connections,
+// and restores the session state when sessionReset is restore.
+func (hc *hiveConn) ResetSession(ctx context.Context) error {
+	if hc.bad {
+		return driver.ErrBadConn
+	}
+	if !hc.session.changed() {
+		return nil
+	}
+	switch hc.sessionReset {
+	case SessionResetNone:
+		hc.session = sessionState{}
+		return nil
+	case SessionResetDiscard:
+		hc.bad = true
+		return driver.ErrBadConn
+	}
+	return hc.restoreSession(ctx)
+}
+
+// IsValid reports whether the connection may go back to the pool: it is not bad, and
+// sessionReset allows reusing its session state.
+func (hc *hiveConn) IsValid() bool {
+	return !hc.bad && hc.reusable()
 }
 
 func (hc *hiveConn) Prepare(query string) (driver.Stmt, error) {
@@ -30,9 +169,13 @@ func (hc *hiveConn) Prepare(query string) (driver.Stmt, error) {
 }
 
 func (hc *hiveConn) Close() error {
-	closeReq := tcliservice.NewTCloseSessionReq()
-	closeReq.SessionHandle = hc.sessHandle
-	_, err := hc.client.CloseSession(hc.ctx, closeReq)
+	var err error
+	// A bad connection has no session worth closing, and may not answer.
+	if !hc.bad && !hc.expired {
+		closeReq := tcliservice.NewTCloseSessionReq()
+		closeReq.SessionHandle = hc.sessHandle
+		_, err = hc.client.CloseSession(context.Background(), closeReq)
+	}
 	if hc.transport != nil {
 		if err := hc.transport.Close(); err != nil {
 			return fmt.Errorf("error closing socket: ")
@@ -45,4 +188,9 @@ func (hc *hiveConn) Begin() (driver.Tx, error) {
 	return nil, errors.New("not support")
 }
 
-var _ driver.Conn = (*hiveConn)(nil)
+var (
+	_ driver.Conn            = (*hiveConn)(nil)
+	_ driver.Pinger          = (*hiveConn)(nil)
+	_ driver.SessionResetter = (*hiveConn)(nil)
+	_ driver.Validator       = (*hiveConn)(nil)
+)
@@ -9,17 +9,23 @@ import (
 	"strings"
 
 	"github.com/apache/thrift/lib/go/thrift"
-	krb "github.com/jcmturner/gokrb5/v8/client"
-	"github.com/jcmturner/gokrb5/v8/config"
-	"github.com/jcmturner/gokrb5/v8/keytab"
 
 	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
-	saslgsskerb "github.com/mumuhhh/gohive2/sasl/gsskerb"
-	saslplain "github.com/mumuhhh/gohive2/sasl/plain"
+	"github.com/mumuhhh/gohive2/sasl"
 )
 
 type connector struct {
-	params *ConnParams
+	params      *ConnParams
+	mechanism   string
+	qop         []string
+	tokenSource TokenSource
+	credentials CredentialProvider
+	dial        DialContextFunc
+	progress    func(Progress)
+	reset       SessionReset
+	undefined   UndefinedVariable
+	stripPrefix *bool
+	uniqueNames *bool
 }
 
 const Kerberos = 1
@@ -29,6 +35,18 @@ func (c *connector) Driver() driver.Driver {
 }
 
 func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.carriesUser() {
+		params, err := resolveCredentials(ctx, c.params, c.credentials)
+		if err != nil {
+			return nil, err
+		}
+		// The rest of the connection sees the resolved credentials; c.params is left as given.
+		resolved := *c
+		resolved.params = params
+		c = &resolved
+	}
+
+	var err error
 	fetchSize := int64(1000)
 	if fetchSizeStr, ok := c.params.SessionVar["fetchSize"]; ok {
 		i, err := strconv.ParseInt(fetchSizeStr, 10, 64)
@@ -36,93 +54,208 @@ func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
 			fetchSize = i
 		}
 	}
-	transport, err := c.openTransport(ctx)
+	reopenExpired := false
+	if value, ok := c.params.SessionVar["reopenExpiredSession"]; ok {
+		if reopenExpired, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid reopenExpiredSession %q: must be true or false", value)
+		}
+	}
+	runAsync := true
+	if value, ok := c.params.SessionVar["runAsync"]; ok {
+		if runAsync, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid runAsync %q: must be true or false", value)
+		}
+	}
+	sessionReset, err := c.sessionResetPolicy()
+	if err != nil {
+		return nil, err
+	}
+	vars, substitute, err := c.variables()
+	if err != nil {
+		return nil, err
+	}
+	stripPrefix, _, err := c.columnNameOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := c.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := c.openTransport(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	protocol := thrift.NewTBinaryProtocolFactoryConf(&thrift.TConfiguration{})
+	// The protocol hands its configuration down to the socket, so it carries the timeout.
+	protocol := thrift.NewTBinaryProtocolFactoryConf(&thrift.TConfiguration{SocketTimeout: opts.socketTimeout})
 	client := tcliservice.NewTCLIServiceClientFactory(transport, protocol)
 
+	stop := closeOnCancel(ctx, transport)
 	openResp, err := c.openSession(ctx, client)
+	if cancelErr := stop(); cancelErr != nil {
+		err = cancelErr
+	}
 	if err != nil {
+		_ = transport.Close()
 		return nil, err
 	}
-	return &hiveConn{
-		transport:  transport,
-		client:     client,
-		sessHandle: openResp.SessionHandle,
-		protocol:   openResp.ServerProtocolVersion,
-		fetchSize:  fetchSize,
-		ctx:        ctx,
-		params:     c.params,
-	}, nil
+	hc := &hiveConn{
+		transport:    transport,
+		client:       client,
+		sessHandle:   openResp.SessionHandle,
+		protocol:     negotiatedProtocol(openResp.ServerProtocolVersion),
+		fetchSize:    fetchSize,
+		params:       c.params,
+		progress:     c.progress,
+		sessionReset: sessionReset,
+		runAsync:     runAsync,
+		vars:         vars,
+		substitute:   substitute,
+		stripPrefix:  stripPrefix,
+	}
+	hc.openSession = func(ctx context.Context) (*tcliservice.TOpenSessionResp, error) {
+		return c.openSession(ctx, client)
+	}
+	if reopenExpired {
+		hc.reopen = hc.openSession
+	}
+	if name, ok := c.params.SessionVar["applicationName"]; ok {
+		// The session was opened with the name as its query tag; servers with
+		// SetClientInfo also show it as the application.
+		hc.clientInfo = map[string]string{ApplicationNameKey: name}
+		if _, err := hc.setClientInfo(ctx, hc.clientInfo); err != nil {
+			_ = hc.Close()
+			return nil, err
+		}
+	}
+	return hc, nil
 }
 
-func (c *connector) openTransport(ctx context.Context) (thrift.TTransport, error) {
-	var transport thrift.TTransport
+func (c *connector) openTransport(ctx context.Context, opts dialOptions) (thrift.TTransport, error) {
+	if c.params.SessionVar["transportMode"] == "http" {
+		return c.openHTTPTransport(opts)
+	}
 	hostPort := c.params.Addresses[0]
-	transport, err := thrift.NewTSocketConf(hostPort, &thrift.TConfiguration{})
+	if c.params.SessionVar["auth"] == "noSasl" {
+		return c.openSocket(ctx, opts, hostPort)
+	}
+
+	host, _, err := net.SplitHostPort(hostPort)
 	if err != nil {
 		return nil, err
 	}
-
-	if c.params.SessionVar["auth"] != "noSasl" {
-		if principal, ok := c.params.SessionVar["principal"]; ok {
-			if userPrincipal, ok := c.params.SessionVar["user.principal"]; ok {
-				kt, err := keytab.Load(c.params.SessionVar["user.keytab"])
-				if err != nil {
-					return nil, err
-				}
-				krb5conf, err := config.Load(c.params.SessionVar["user.krb5.conf"])
-				if err != nil {
-					return nil, err
-				}
-				username := strings.Split(userPrincipal, "@")
-				krbClient := krb.NewWithKeytab(username[0], username[1], kt, krb5conf)
-				spn := strings.FieldsFunc(principal, func(r rune) bool {
-					return r == '/' || r == '@'
-				})
-				host, _, err := net.SplitHostPort(hostPort)
-				if err != nil {
-					return nil, err
-				} else {
-					if addrs, err := net.LookupAddr(host); err != nil {
-						return nil, err
-					} else if len(addrs) > 0 {
-						host = addrs[0]
-					}
-				}
-				saslClient := saslgsskerb.NewGssKerbClient("", spn[0], host, krbClient)
-				transport = NewTSaslClientTransport(transport, saslClient)
-			}
-		} else {
-			username, ok := c.params.SessionVar["username"]
-			if !ok {
-				username = "anonymous"
-			}
-			password, ok := c.params.SessionVar["password"]
-			if !ok {
-				password = "anonymous"
-			}
-			saslClient := saslplain.NewPlainClient("", username, password)
-			transport = NewTSaslClientTransport(transport, saslClient)
+	saslClient, err := sasl.NewClient(c.saslMechanism(), c.params.SessionVar, host)
+	if err != nil {
+		return nil, err
+	}
+	allowedQop, err := c.allowedQop()
+	if err != nil {
+		return nil, err
+	}
+	if policy, ok := saslClient.(sasl.QopPolicy); ok {
+		policy.SetAllowedQop(allowedQop)
+	}
+	if maxBufferStr, ok := c.params.SessionVar["saslMaxBuffer"]; ok {
+		maxBuffer, err := strconv.Atoi(maxBufferStr)
+		if err != nil || maxBuffer < 1 || maxBuffer > sasl.MaxMaxBuffer {
+			return nil, fmt.Errorf("invalid saslMaxBuffer %q: must be between 1 and %d", maxBufferStr, sasl.MaxMaxBuffer)
+		}
+		if policy, ok := saslClient.(sasl.MaxBufferPolicy); ok {
+			policy.SetMaxBuffer(maxBuffer)
+		}
+	}
+	maxFrameSize := DefaultMaxFrameSize
+	if maxFrameSizeStr, ok := c.params.SessionVar["saslMaxFrameSize"]; ok {
+		maxFrameSize, err = strconv.Atoi(maxFrameSizeStr)
+		if err != nil || maxFrameSize < 1 {
+			return nil, fmt.Errorf("invalid saslMaxFrameSize %q: must be a positive number of bytes", maxFrameSizeStr)
 		}
 	}
 
-	if err := transport.Open(); err != nil {
+	socket, err := c.openSocket(ctx, opts, hostPort)
+	if err != nil {
 		return nil, err
 	}
+	transport := NewTSaslClientTransport(socket, saslClient)
+	transport.SetMaxFrameSize(maxFrameSize)
+	// The negotiation is abandoned when ctx is done.
+	stop := closeOnCancel(ctx, socket)
+	err = transport.Open()
+	if cancelErr := stop(); cancelErr != nil {
+		err = cancelErr
+	}
+	if err != nil {
+		_ = socket.Close()
+		return nil, err
+	}
+	qop, err := saslClient.GetNegotiatedProperty("sasl.qop")
+	if err != nil {
+		_ = transport.Close()
+		return nil, err
+	}
+	if !sasl.QopAllowed(allowedQop, qop) {
+		_ = transport.Close()
+		return nil, fmt.Errorf("%s negotiated quality of protection %q, but saslQop requires %v",
+			saslClient.GetMechanismName(), qop, allowedQop)
+	}
 	return transport, nil
 }
 
+// openSocket dials hostPort; reads and writes on the socket time out after socketTimeout.
+func (c *connector) openSocket(ctx context.Context, opts dialOptions, hostPort string) (*thrift.TSocket, error) {
+	conn, err := c.dialContext(opts)(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return thrift.NewTSocketFromConnConf(conn, &thrift.TConfiguration{SocketTimeout: opts.socketTimeout}), nil
+}
+
+// saslMechanism returns the configured SASL mechanism, defaulting to GSSAPI when a
+// Kerberos principal is given, DIGEST-MD5 for delegation tokens and PLAIN otherwise.
+func (c *connector) saslMechanism() string {
+	if c.mechanism != "" {
+		return strings.ToUpper(c.mechanism)
+	}
+	if mechanism, ok := c.params.SessionVar["saslMechanism"]; ok {
+		return strings.ToUpper(mechanism)
+	}
+	if c.params.SessionVar["auth"] == "delegationToken" {
+		return "DIGEST-MD5"
+	}
+	if _, ok := c.params.SessionVar["principal"]; ok {
+		return "GSSAPI"
+	}
+	return "PLAIN"
+}
+
+func (c *connector) allowedQop() ([]string, error) {
+	if c.qop != nil {
+		return sasl.ParseQop(strings.Join(c.qop, ","))
+	}
+	return sasl.ParseQop(c.params.SessionVar["saslQop"])
+}
+
 func (c *connector) openSession(ctx context.Context, client *tcliservice.TCLIServiceClient) (*tcliservice.TOpenSessionResp, error) {
 	openSessionReq := tcliservice.NewTOpenSessionReq()
-	openSessionReq.ClientProtocol = tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V8
+	openSessionReq.ClientProtocol = clientProtocol
 	openConf := map[string]string{}
+	if name, ok := c.params.SessionVar["applicationName"]; ok {
+		labels, err := sessionLabels(name)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range labels {
+			openConf[k] = v
+		}
+	}
 	for k, v := range c.params.HiveConf {
 		openConf["set:hiveconf:"+k] = v
 	}
+	// Connect validated the option already.
+	if _, unique, _ := c.columnNameOptions(); unique != "" {
+		openConf["set:hiveconf:"+uniqueColumnNamesConf] = unique
+	}
 	// For remote JDBC client, try to set the hive var using 'set hivevar:key=value'
 	for k, v := range c.params.HiveVar {
 		openConf["set:hivevar:"+k] = v
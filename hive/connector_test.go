@@ -0,0 +1,91 @@
+package hive2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+func TestSaslMechanismSelection(t *testing.T) {
+	tests := []struct {
+		url       string
+		opts      []ConnectorOption
+		mechanism string
+	}{
+		{url: "hive2://hs2:10000/default", mechanism: "PLAIN"},
+		{url: "hive2://hs2:10000/default;principal=hive/_HOST@HADOOP.COM", mechanism: "GSSAPI"},
+		{url: "hive2://hs2:10000/default;auth=delegationToken;delegationToken=x", mechanism: "DIGEST-MD5"},
+		{url: "hive2://hs2:10000/default;saslMechanism=cram-md5", mechanism: "CRAM-MD5"},
+		{url: "hive2://hs2:10000/default;saslMechanism=CRAM-MD5", opts: []ConnectorOption{WithSaslMechanism("digest-md5")}, mechanism: "DIGEST-MD5"},
+	}
+	for _, tt := range tests {
+		params, err := ParseUrl(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewConnector(params, tt.opts...).(*connector)
+		if got := c.saslMechanism(); got != tt.mechanism {
+			t.Errorf("%s: mechanism = %q, want %q", tt.url, got, tt.mechanism)
+		}
+	}
+}
+
+func TestNewSaslClient(t *testing.T) {
+	for _, mechanism := range []string{"PLAIN", "CRAM-MD5", "DIGEST-MD5", "SCRAM-SHA-256"} {
+		params, err := ParseUrl("hive2://hs2:10000/default;username=u;password=p;saslMechanism=" + mechanism)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := sasl.NewClient(NewConnector(params).(*connector).saslMechanism(), params.SessionVar, "hs2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := client.GetMechanismName(); got != mechanism {
+			t.Errorf("mechanism = %q, want %q", got, mechanism)
+		}
+	}
+
+	params, _ := ParseUrl("hive2://hs2:10000/default;saslMechanism=SCRAM-MD4")
+	if _, err := sasl.NewClient(NewConnector(params).(*connector).saslMechanism(), params.SessionVar, "hs2"); err == nil {
+		t.Error("unknown mechanism should fail")
+	}
+	params, _ = ParseUrl("hive2://hs2:10000/default;saslMechanism=GSSAPI")
+	if _, err := sasl.NewClient(NewConnector(params).(*connector).saslMechanism(), params.SessionVar, "hs2"); err == nil {
+		t.Error("GSSAPI without principal should fail")
+	}
+}
+
+func TestAllowedQop(t *testing.T) {
+	params, _ := ParseUrl("hive2://hs2:10000/default;saslQop=auth-conf,auth-int")
+	qop, err := NewConnector(params).(*connector).allowedQop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(qop, []string{sasl.QopPrivacy, sasl.QopIntegrity}) {
+		t.Errorf("qop = %v", qop)
+	}
+
+	qop, err = NewConnector(params, WithSaslQop(sasl.QopAuthentication)).(*connector).allowedQop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(qop, []string{sasl.QopAuthentication}) {
+		t.Errorf("qop = %v", qop)
+	}
+
+	params, _ = ParseUrl("hive2://hs2:10000/default;saslQop=auth-none")
+	if _, err := NewConnector(params).(*connector).allowedQop(); err == nil {
+		t.Error("invalid saslQop should fail")
+	}
+
+	if got := sasl.SelectQop(nil, []string{"auth", "auth-int", "auth-conf"}); got != sasl.QopPrivacy {
+		t.Errorf("SelectQop = %q, want strongest", got)
+	}
+	if got := sasl.SelectQop([]string{"auth", "auth-int"}, []string{"auth-conf", "auth-int"}); got != sasl.QopIntegrity {
+		t.Errorf("SelectQop = %q, want auth-int", got)
+	}
+	if got := sasl.SelectQop([]string{"auth-conf"}, []string{"auth"}); got != "" {
+		t.Errorf("SelectQop = %q, want none", got)
+	}
+}
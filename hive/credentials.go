@@ -0,0 +1,234 @@
+package hive2
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	userEnvVar      = "HIVE_USER"
+	passwordEnvVar  = "HIVE_PASSWORD"
+	passFileEnvVar  = "HIVEPASSFILE"
+	defaultPassFile = ".hivepass"
+)
+
+// Credentials are the user name and password used by noSasl sessions, PLAIN, CRAM-MD5,
+// DIGEST-MD5, SCRAM and HTTP basic authentication. When none are given, PLAIN and HTTP
+// basic authentication log in as the user anonymous with the password anonymous, as the
+// Hive JDBC driver does for servers without authentication, and log a warning; CRAM-MD5,
+// DIGEST-MD5 and SCRAM fail.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialProvider returns the credentials for connecting to hostPort. It is called for
+// every new connection, so it may hand out short-lived passwords.
+type CredentialProvider func(ctx context.Context, hostPort string) (Credentials, error)
+
+// resolveCredentials returns a copy of params with the user name and password filled in
+// from the first source that has them:
+//
+//  1. the provider given with WithCredentials;
+//  2. the username and password parameters;
+//  3. the file named by the passwordFile parameter, for the password only;
+//  4. the HIVE_USER and HIVE_PASSWORD environment variables;
+//  5. the first matching line of the credentials file named by the credentialsFile
+//     parameter, the HIVEPASSFILE environment variable or ~/.hivepass.
+//
+// Without any of them the connection falls back to anonymous or fails, see Credentials.
+func resolveCredentials(ctx context.Context, params *ConnParams, provider CredentialProvider) (*ConnParams, error) {
+	resolved := *params
+	resolved.SessionVar = make(map[string]string, len(params.SessionVar)+2)
+	for k, v := range params.SessionVar {
+		resolved.SessionVar[k] = v
+	}
+	vars := resolved.SessionVar
+
+	if provider != nil {
+		creds, err := provider(ctx, params.Addresses[0])
+		if err != nil {
+			return nil, fmt.Errorf("credential provider: %w", err)
+		}
+		if creds.Username != "" {
+			vars["username"] = creds.Username
+		}
+		vars["password"] = creds.Password
+		return &resolved, nil
+	}
+
+	if _, ok := vars["password"]; !ok {
+		if path := vars["passwordFile"]; path != "" {
+			password, err := readPasswordFile(path)
+			if err != nil {
+				return nil, err
+			}
+			vars["password"] = password
+		} else if password, ok := os.LookupEnv(passwordEnvVar); ok {
+			vars["password"] = password
+		}
+	}
+	if _, ok := vars["username"]; !ok {
+		if username, ok := os.LookupEnv(userEnvVar); ok {
+			vars["username"] = username
+		}
+	}
+	if _, ok := vars["password"]; ok {
+		return &resolved, nil
+	}
+
+	// Only a file named by the credentialsFile parameter has to exist.
+	path, explicit := vars["credentialsFile"], true
+	if path == "" {
+		path, explicit = os.Getenv(passFileEnvVar), false
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &resolved, nil
+		}
+		path, explicit = filepath.Join(home, defaultPassFile), false
+	}
+	entries, err := readCredentialsFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return &resolved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(params.Addresses[0])
+	if err != nil {
+		return nil, err
+	}
+	if creds, ok := entries.lookup(host, port, params.DBName, vars["username"]); ok {
+		if creds.Username != "" {
+			vars["username"] = creds.Username
+		}
+		vars["password"] = creds.Password
+	}
+	return &resolved, nil
+}
+
+// carriesUser reports whether the connection sends a user name, usually with a
+// password, and so needs credentials resolved: noSasl sessions, HTTP basic authentication
+// and every SASL mechanism but GSSAPI do. JWT, delegation token and Kerberos connections
+// do not depend on password files.
+func (c *connector) carriesUser() bool {
+	vars := c.params.SessionVar
+	switch {
+	case vars["transportMode"] == "http":
+		return vars["auth"] != "jwt"
+	case vars["auth"] == "noSasl":
+		return true
+	case vars["auth"] == "delegationToken":
+		return false
+	}
+	return c.saslMechanism() != "GSSAPI"
+}
+
+// checkPrivate refuses secret files that users other than the owner can read or write.
+func checkPrivate(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s has permissions %v; it must not be accessible by group or others (chmod 600)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// readPasswordFile returns the first line of the file at path.
+func readPasswordFile(path string) (string, error) {
+	if err := checkPrivate(path); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	password := string(data)
+	if i := strings.IndexAny(password, "\r\n"); i >= 0 {
+		password = password[:i]
+	}
+	return password, nil
+}
+
+// credentialsEntry is a line of a credentials file: host:port:database:username:password,
+// in which the first four fields may be * to match anything.
+type credentialsEntry struct {
+	host, port, database, username, password string
+}
+
+type credentialsFile []credentialsEntry
+
+// readCredentialsFile parses a .pgpass-style file. Blank lines and lines starting with #
+// are ignored; ':' and '\' are escaped with a backslash.
+func readCredentialsFile(path string) (credentialsFile, error) {
+	if err := checkPrivate(path); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries credentialsFile
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitCredentialsLine(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: expected host:port:database:username:password", path, n)
+		}
+		entries = append(entries, credentialsEntry{fields[0], fields[1], fields[2], fields[3], fields[4]})
+	}
+	return entries, scanner.Err()
+}
+
+func splitCredentialsLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case c == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// lookup returns the credentials of the first entry matching the connection. An empty
+// username matches any entry, whose user name is then used unless it is *.
+func (f credentialsFile) lookup(host, port, database, username string) (Credentials, bool) {
+	match := func(pattern, value string) bool {
+		return pattern == "*" || pattern == value
+	}
+	for _, e := range f {
+		if match(e.host, host) && match(e.port, port) && match(e.database, database) &&
+			(username == "" || match(e.username, username)) {
+			if username == "" && e.username != "*" {
+				username = e.username
+			}
+			return Credentials{Username: username, Password: e.password}, true
+		}
+	}
+	return Credentials{}, false
+}
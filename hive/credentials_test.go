@@ -0,0 +1,263 @@
+package hive2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+func writeSecretFile(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestResolveCredentials(t *testing.T) {
+	setenv(t, passFileEnvVar, filepath.Join(t.TempDir(), "missing"))
+	passwordFile := writeSecretFile(t, "from-file\nignored\n", 0o600)
+	credentialsFile := writeSecretFile(t, strings.Join([]string{
+		"# host:port:database:username:password",
+		"hs2.example.com:10000:sales:etl:etl-pass",
+		`hs2.example.com:10000:*:*:any\:user`,
+		"*:*:*:fallback:fallback-pass",
+	}, "\n"), 0o600)
+
+	tests := []struct {
+		name     string
+		uri      string
+		env      map[string]string
+		provider CredentialProvider
+		username string
+		password string
+	}{
+		{name: "parameters", uri: ";username=u;password=p", username: "u", password: "p"},
+		{name: "nothing", uri: "", username: "", password: ""},
+		{name: "password file", uri: ";username=u;passwordFile=" + passwordFile, username: "u", password: "from-file"},
+		{name: "environment", uri: "", env: map[string]string{userEnvVar: "env-user", passwordEnvVar: "env-pass"}, username: "env-user", password: "env-pass"},
+		{name: "parameter beats environment", uri: ";password=p", env: map[string]string{passwordEnvVar: "env-pass"}, password: "p"},
+		{name: "credentials file with user", uri: ";username=etl;credentialsFile=" + credentialsFile, username: "etl", password: "etl-pass"},
+		{name: "credentials file wildcard user", uri: ";username=bob;credentialsFile=" + credentialsFile, username: "bob", password: "any:user"},
+		{name: "credentials file from environment", uri: ";username=etl", env: map[string]string{passFileEnvVar: credentialsFile}, username: "etl", password: "etl-pass"},
+		{
+			name: "provider",
+			uri:  ";username=u;password=p",
+			provider: func(_ context.Context, hostPort string) (Credentials, error) {
+				return Credentials{Username: "vault", Password: "token-for-" + hostPort}, nil
+			},
+			username: "vault",
+			password: "token-for-hs2.example.com:10000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				setenv(t, k, v)
+			}
+			params, err := ParseUrl("hive2://hs2.example.com:10000/sales" + tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resolved, err := resolveCredentials(context.Background(), params, tt.provider)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resolved.SessionVar["username"]; got != tt.username {
+				t.Errorf("username = %q, want %q", got, tt.username)
+			}
+			if got := resolved.SessionVar["password"]; got != tt.password {
+				t.Errorf("password = %q, want %q", got, tt.password)
+			}
+			if _, ok := params.SessionVar["password"]; ok && !strings.Contains(tt.uri, "password=") {
+				t.Error("resolveCredentials modified the given parameters")
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsErrors(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		open := writeSecretFile(t, "secret", 0o644)
+		params, _ := ParseUrl("hive2://hs2:10000/default;passwordFile=" + open)
+		if _, err := resolveCredentials(context.Background(), params, nil); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+			t.Errorf("expected a permission error, got %v", err)
+		}
+		params, _ = ParseUrl("hive2://hs2:10000/default;credentialsFile=" + open)
+		if _, err := resolveCredentials(context.Background(), params, nil); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+			t.Errorf("expected a permission error, got %v", err)
+		}
+	}
+
+	params, _ := ParseUrl("hive2://hs2:10000/default;credentialsFile=" + filepath.Join(t.TempDir(), "missing"))
+	if _, err := resolveCredentials(context.Background(), params, nil); err == nil {
+		t.Error("expected an error for a missing credentials file")
+	}
+
+	malformed := writeSecretFile(t, "hs2:10000:default:user", 0o600)
+	params, _ = ParseUrl("hive2://hs2:10000/default;credentialsFile=" + malformed)
+	if _, err := resolveCredentials(context.Background(), params, nil); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+
+	failing := func(context.Context, string) (Credentials, error) {
+		return Credentials{}, errors.New("vault sealed")
+	}
+	params, _ = ParseUrl("hive2://hs2:10000/default")
+	if _, err := resolveCredentials(context.Background(), params, failing); err == nil || !strings.Contains(err.Error(), "vault sealed") {
+		t.Errorf("expected the provider error, got %v", err)
+	}
+}
+
+func TestCarriesUser(t *testing.T) {
+	tests := []struct {
+		params string
+		want   bool
+	}{
+		{"", true},
+		{";saslMechanism=CRAM-MD5", true},
+		{";saslMechanism=SCRAM-SHA-256", true},
+		{";saslMechanism=DIGEST-MD5", true},
+		{";saslMechanism=X-CUSTOM", true},
+		{";auth=noSasl", true},
+		{";auth=delegationToken;delegationToken=abc", false},
+		{";principal=hive/_HOST@HADOOP.COM", false},
+		{";transportMode=http", true},
+		{";transportMode=http;auth=jwt", false},
+	}
+	for _, tt := range tests {
+		params, err := ParseUrl("hive2://hs2:10000/default" + tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := NewConnector(params).(*connector).carriesUser(); got != tt.want {
+			t.Errorf("carriesUser(%q) = %v, want %v", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestConnectIgnoresPassFileWithoutUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on windows")
+	}
+	setenv(t, passFileEnvVar, writeSecretFile(t, "not a credentials line", 0o644))
+	s := startFakeHTTPServer(t, newFakeHive(), "Bearer fresh")
+	if err := connectHTTP(t, s, ";auth=jwt;jwt=fresh"); err != nil {
+		t.Fatalf("a JWT connection should not read the credentials file: %v", err)
+	}
+}
+
+func TestConnectNoSaslCredentials(t *testing.T) {
+	setenv(t, userEnvVar, "env-user")
+	setenv(t, passwordEnvVar, "env-pass")
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if req := hive.openReqs[0]; req.GetUsername() != "env-user" || req.GetPassword() != "env-pass" {
+		t.Errorf("OpenSession sent %q/%q, want the credentials of the environment", req.GetUsername(), req.GetPassword())
+	}
+}
+
+func TestPasswordMechanismsRequireCredentials(t *testing.T) {
+	for _, mechanism := range []string{"CRAM-MD5", "DIGEST-MD5", "SCRAM-SHA-256"} {
+		if _, err := sasl.NewClient(mechanism, map[string]string{"username": "etl"}, "hs2"); err == nil || !strings.Contains(err.Error(), "requires a user name and password") {
+			t.Errorf("%s without a password: got %v", mechanism, err)
+		}
+		if _, err := sasl.NewClient(mechanism, map[string]string{"username": "etl", "password": "secret"}, "hs2"); err != nil {
+			t.Errorf("%s: %v", mechanism, err)
+		}
+	}
+}
+
+func TestConnectWithCredentials(t *testing.T) {
+	factory := NewTSaslServerTransportFactory()
+	for name, mechanism := range testServerMechanisms() {
+		factory.AddServerDefinition(name, mechanism)
+	}
+	server := startFakeServerWithTransport(t, newFakeHive(), factory)
+	params, err := ParseUrl("hive2://" + server.addr() + "/default;saslMechanism=PLAIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := func(context.Context, string) (Credentials, error) {
+		return Credentials{Username: "hive", Password: "hive-secret"}, nil
+	}
+	conn, err := NewConnector(params, WithCredentials(provider)).Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, ok := params.SessionVar["password"]; ok {
+		t.Error("the connector's parameters should not keep the provided password")
+	}
+}
+
+func TestConnParamsRedaction(t *testing.T) {
+	params, err := ParseUrl("hive2://hs2:10000/default;username=etl;password=s3cret;ssl=true;trustStorePassword=changeit;auth=jwt;jwt=eyJ.payload.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.JdbcUriString = "jdbc:hive2://hs2:10000/default;password=s3cret;user=etl"
+	marshaled, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, out := range map[string]string{
+		"String":      params.String(),
+		"%v":          fmt.Sprintf("%v", params),
+		"%+v":         fmt.Sprintf("%+v", *params),
+		"%#v":         fmt.Sprintf("%#v", params),
+		"MarshalJSON": string(marshaled),
+	} {
+		for _, secret := range []string{"s3cret", "changeit", "eyJ"} {
+			if strings.Contains(out, secret) {
+				t.Errorf("%s leaks %q: %s", name, secret, out)
+			}
+		}
+		if !strings.Contains(out, "etl") {
+			t.Errorf("%s hides non-secret values: %s", name, out)
+		}
+	}
+	if params.SessionVar["password"] != "s3cret" {
+		t.Error("redaction modified the parameters")
+	}
+
+	simple := ConnParams{DBName: "sales", Addresses: []string{"hs2:10000"}, SessionVar: map[string]string{"password": "s3cret"}}
+	want := `hive2.ConnParams{DBName:"sales", JdbcUriString:"", Addresses:[]string{"hs2:10000"}, HiveConf:map[string]string(nil), HiveVar:map[string]string(nil), SessionVar:map[string]string{"password":"******"}}`
+	if got := fmt.Sprintf("%#v", simple); got != want {
+		t.Errorf("%%#v = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+package hive2
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// Hive's DIGEST-MD5 server is created without a protocol and with Hadoop's default SASL
+// realm as server name, which the Java client turns into the digest-uri "null/default".
+const (
+	tokenSaslProtocol   = "null"
+	tokenSaslServerName = "default"
+)
+
+// withHiveConn runs f with the driver connection underlying conn.
+func withHiveConn(conn *sql.Conn, f func(hc *hiveConn) error) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		hc, ok := driverConn.(*hiveConn)
+		if !ok {
+			return fmt.Errorf("hive2: unexpected driver connection %T", driverConn)
+		}
+		return f(hc)
+	})
+}
+
+// GetDelegationToken obtains a HiveServer2 delegation token for owner, renewable by
+// renewer. The connection must be authenticated with Kerberos. The returned token is in
+// Hadoop's URL-safe string encoding and can be passed as the delegationToken connection
+// parameter together with auth=delegationToken.
+func GetDelegationToken(ctx context.Context, conn *sql.Conn, owner, renewer string) (token string, err error) {
+	err = withHiveConn(conn, func(hc *hiveConn) error {
+		req := tcliservice.NewTGetDelegationTokenReq()
+		req.SessionHandle = hc.sessHandle
+		req.Owner = owner
+		req.Renewer = renewer
+		resp, err := hc.client.GetDelegationToken(ctx, req)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return hc.serverError(resp.GetStatus())
+		}
+		token = resp.GetDelegationToken()
+		return nil
+	})
+	return token, err
+}
+
+// RenewDelegationToken extends the lifetime of a token obtained with GetDelegationToken.
+func RenewDelegationToken(ctx context.Context, conn *sql.Conn, token string) error {
+	return withHiveConn(conn, func(hc *hiveConn) error {
+		req := tcliservice.NewTRenewDelegationTokenReq()
+		req.SessionHandle = hc.sessHandle
+		req.DelegationToken = token
+		resp, err := hc.client.RenewDelegationToken(ctx, req)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return hc.serverError(resp.GetStatus())
+		}
+		return nil
+	})
+}
+
+// CancelDelegationToken invalidates a token obtained with GetDelegationToken.
+func CancelDelegationToken(ctx context.Context, conn *sql.Conn, token string) error {
+	return withHiveConn(conn, func(hc *hiveConn) error {
+		req := tcliservice.NewTCancelDelegationTokenReq()
+		req.SessionHandle = hc.sessHandle
+		req.DelegationToken = token
+		resp, err := hc.client.CancelDelegationToken(ctx, req)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return hc.serverError(resp.GetStatus())
+		}
+		return nil
+	})
+}
+
+// delegationToken is a Hadoop security token as serialized by Token.encodeToUrlString.
+type delegationToken struct {
+	identifier []byte
+	password   []byte
+	kind       string
+	service    string
+}
+
+// saslUsername and saslPassword are the DIGEST-MD5 credentials Hadoop derives from a token.
+func (t *delegationToken) saslUsername() string {
+	return base64.StdEncoding.EncodeToString(t.identifier)
+}
+
+func (t *delegationToken) saslPassword() string {
+	return base64.StdEncoding.EncodeToString(t.password)
+}
+
+func decodeDelegationToken(s string) (*delegationToken, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delegation token: %v", err)
+	}
+	r := bytes.NewReader(data)
+	t := &delegationToken{}
+	if t.identifier, err = readWritableBytes(r); err != nil {
+		return nil, fmt.Errorf("invalid delegation token: %v", err)
+	}
+	if t.password, err = readWritableBytes(r); err != nil {
+		return nil, fmt.Errorf("invalid delegation token: %v", err)
+	}
+	kind, err := readWritableBytes(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delegation token: %v", err)
+	}
+	service, err := readWritableBytes(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delegation token: %v", err)
+	}
+	t.kind, t.service = string(kind), string(service)
+	return t, nil
+}
+
+// readWritableBytes reads a byte array prefixed by its length as a Hadoop variable-length
+// integer, the layout used by both Token and Text.
+func readWritableBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := readVLong(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > int64(r.Len()) {
+		return nil, fmt.Errorf("bad field length %d", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// readVLong decodes a Hadoop WritableUtils variable-length long.
+func readVLong(r *bytes.Reader) (int64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, errors.New("truncated variable-length integer")
+	}
+	v := int8(first)
+	if v >= -112 {
+		return int64(v), nil
+	}
+	negative := v < -120
+	size := int(-111 - int(v))
+	if negative {
+		size = int(-119 - int(v))
+	}
+	var i int64
+	for idx := 0; idx < size-1; idx++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errors.New("truncated variable-length integer")
+		}
+		i = i<<8 | int64(b)
+	}
+	if negative {
+		return ^i, nil
+	}
+	return i, nil
+}
@@ -0,0 +1,167 @@
+package hive2
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+// writeVLong encodes i the way Hadoop's WritableUtils.writeVLong does.
+func writeVLong(buf *bytes.Buffer, i int64) {
+	if i >= -112 && i <= 127 {
+		buf.WriteByte(byte(i))
+		return
+	}
+	size := -112
+	if i < 0 {
+		i = ^i
+		size = -120
+	}
+	for tmp := i; tmp != 0; tmp >>= 8 {
+		size--
+	}
+	buf.WriteByte(byte(size))
+	if size < -120 {
+		size = -(size + 120)
+	} else {
+		size = -(size + 112)
+	}
+	for idx := size; idx != 0; idx-- {
+		buf.WriteByte(byte(i >> uint((idx-1)*8)))
+	}
+}
+
+func encodeTestToken(identifier, password []byte, kind, service string) string {
+	buf := new(bytes.Buffer)
+	for _, field := range [][]byte{identifier, password, []byte(kind), []byte(service)} {
+		writeVLong(buf, int64(len(field)))
+		buf.Write(field)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestReadVLong(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 127, -112, 128, -113, 300, 65536, -65537, 1 << 40} {
+		buf := new(bytes.Buffer)
+		writeVLong(buf, v)
+		got, err := readVLong(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("readVLong(%d): %v", v, err)
+		}
+		if got != v {
+			t.Errorf("readVLong = %d, want %d", got, v)
+		}
+	}
+}
+
+func TestDecodeDelegationToken(t *testing.T) {
+	identifier := bytes.Repeat([]byte{0xfb, 0x01}, 100)
+	password := []byte{0xde, 0xad, 0xbe, 0xef}
+	encoded := encodeTestToken(identifier, password, "HIVE_DELEGATION_TOKEN", "hiveserver2ClientToken")
+
+	token, err := decodeDelegationToken(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(token.identifier, identifier) || !bytes.Equal(token.password, password) {
+		t.Errorf("decoded token = %+v", token)
+	}
+	if token.kind != "HIVE_DELEGATION_TOKEN" || token.service != "hiveserver2ClientToken" {
+		t.Errorf("kind = %q, service = %q", token.kind, token.service)
+	}
+	if got := token.saslUsername(); got != base64.StdEncoding.EncodeToString(identifier) {
+		t.Errorf("saslUsername = %q", got)
+	}
+	if got := token.saslPassword(); got != "3q2+7w==" {
+		t.Errorf("saslPassword = %q", got)
+	}
+
+	if _, err := decodeDelegationToken(encoded[:20]); err == nil {
+		t.Error("truncated token should not decode")
+	}
+	if _, err := decodeDelegationToken("not a token!"); err == nil {
+		t.Error("malformed token should not decode")
+	}
+}
+
+func TestDelegationTokenLifecycle(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	db := openFakeDB(t, server, "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	token, err := GetDelegationToken(ctx, conn, "etl", "oozie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token-etl-oozie" {
+		t.Fatalf("token = %q", token)
+	}
+	if err := RenewDelegationToken(ctx, conn, token); err != nil {
+		t.Fatal(err)
+	}
+	if hive.tokens[token] != "renewed" {
+		t.Errorf("token state = %q, want renewed", hive.tokens[token])
+	}
+	if err := CancelDelegationToken(ctx, conn, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenewDelegationToken(ctx, conn, token); err == nil {
+		t.Error("renewing a cancelled token should fail")
+	}
+}
+
+func TestDelegationTokenLostSession(t *testing.T) {
+	calls := map[string]func(ctx context.Context, conn *sql.Conn) error{
+		"get": func(ctx context.Context, conn *sql.Conn) error {
+			_, err := GetDelegationToken(ctx, conn, "etl", "oozie")
+			return err
+		},
+		"renew": func(ctx context.Context, conn *sql.Conn) error {
+			return RenewDelegationToken(ctx, conn, "token-etl-oozie")
+		},
+		"cancel": func(ctx context.Context, conn *sql.Conn) error {
+			return CancelDelegationToken(ctx, conn, "token-etl-oozie")
+		},
+	}
+	for name, call := range calls {
+		for _, reopen := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s reopen=%v", name, reopen), func(t *testing.T) {
+				hive := newFakeHive()
+				params := ""
+				if reopen {
+					params = ";reopenExpiredSession=true"
+				}
+				db := openFakeDB(t, startFakeServer(t, hive), params)
+				ctx := context.Background()
+				conn, err := db.Conn(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				hive.expireSessions()
+				if err := call(ctx, conn); err == nil {
+					t.Fatal("expected the Invalid SessionHandle error")
+				}
+				// The connection is expired when it can reopen the session, bad otherwise.
+				err = withHiveConn(conn, func(hc *hiveConn) error {
+					if hc.expired != reopen || hc.bad == reopen {
+						t.Errorf("expired %v, bad %v", hc.expired, hc.bad)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
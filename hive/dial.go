@@ -0,0 +1,114 @@
+package hive2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DialContextFunc opens the network connection to HiveServer2, as net.Dialer.DialContext
+// does. A custom one can go through a SOCKS proxy or an SSH tunnel, or connect tests to an
+// in-memory listener.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialOptions are the socket settings of a connection, from the connectTimeout and
+// socketTimeout parameters in milliseconds and the socketKeepAlive parameter.
+type dialOptions struct {
+	connectTimeout time.Duration
+	socketTimeout  time.Duration
+	// keepAlive is nil unless socketKeepAlive is given; TCP keepalive is then left to
+	// the dialer, which net.Dialer enables by default.
+	keepAlive *bool
+}
+
+func (c *connector) dialOptions() (dialOptions, error) {
+	var opts dialOptions
+	var err error
+	if opts.connectTimeout, err = millisParam(c.params.SessionVar, "connectTimeout"); err != nil {
+		return opts, err
+	}
+	if opts.socketTimeout, err = millisParam(c.params.SessionVar, "socketTimeout"); err != nil {
+		return opts, err
+	}
+	if value, ok := c.params.SessionVar["socketKeepAlive"]; ok {
+		keepAlive, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid socketKeepAlive %q: must be true or false", value)
+		}
+		opts.keepAlive = &keepAlive
+	}
+	return opts, nil
+}
+
+// millisParam returns the duration given in milliseconds by a connection parameter, zero
+// when it is absent.
+func millisParam(vars map[string]string, name string) (time.Duration, error) {
+	value, ok := vars[name]
+	if !ok {
+		return 0, nil
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || millis < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a number of milliseconds", name, value)
+	}
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+// dialContext returns the function opening connections: the WithDialContext one, or a
+// net.Dialer. Either way, connectTimeout bounds the dial and socketKeepAlive is applied
+// to TCP connections.
+func (c *connector) dialContext(opts dialOptions) DialContextFunc {
+	dial := c.dial
+	if dial == nil {
+		dialer := &net.Dialer{}
+		if opts.keepAlive != nil && !*opts.keepAlive {
+			dialer.KeepAlive = -1
+		}
+		dial = dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if opts.connectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.connectTimeout)
+			defer cancel()
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok && opts.keepAlive != nil {
+			if err := tcp.SetKeepAlive(*opts.keepAlive); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+// closeOnCancel closes c if ctx is done before the returned function is called; that
+// function then returns the context's error. Reads and writes blocked on c return as soon
+// as it is closed.
+func closeOnCancel(ctx context.Context, c io.Closer) func() error {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+			result <- ctx.Err()
+		case <-done:
+			result <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
@@ -0,0 +1,163 @@
+package hive2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redirectDialer dials target whatever the address asked for, recording the addresses.
+type redirectDialer struct {
+	target string
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *redirectDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.target)
+}
+
+func (d *redirectDialer) dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.addrs...)
+}
+
+// silentListener accepts connections and never answers.
+func silentListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestWithDialContext(t *testing.T) {
+	factory := NewTSaslServerTransportFactory()
+	for name, mechanism := range testServerMechanisms() {
+		factory.AddServerDefinition(name, mechanism)
+	}
+	binary := startFakeServer(t, newFakeHive())
+	sasl := startFakeServerWithTransport(t, newFakeHive(), factory)
+	http := startFakeHTTPServer(t, newFakeHive(), "Basic aGl2ZTpoaXZlLXNlY3JldA==")
+
+	tests := []struct {
+		name   string
+		target string
+		params string
+	}{
+		{"binary", binary.addr(), ";auth=noSasl"},
+		{"sasl", sasl.addr(), ";saslMechanism=PLAIN"},
+		{"http", strings.TrimPrefix(http.URL, "http://"), ";transportMode=http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ParseUrl("hive2://hs2.invalid:10000/default;username=hive;password=hive-secret" + tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dialer := &redirectDialer{target: tt.target}
+			conn, err := NewConnector(params, WithDialContext(dialer.dial)).Connect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if addrs := dialer.dialed(); len(addrs) == 0 || addrs[0] != "hs2.invalid:10000" {
+				t.Errorf("dialed %v", addrs)
+			}
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	blocking := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	params, _ := ParseUrl("hive2://hs2.invalid:10000/default;auth=noSasl;connectTimeout=50")
+	start := time.Now()
+	_, err := NewConnector(params, WithDialContext(blocking)).Connect(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("connectTimeout took %v", elapsed)
+	}
+}
+
+func TestSocketTimeout(t *testing.T) {
+	addr := silentListener(t)
+	for _, params := range []string{";auth=noSasl", ";saslMechanism=PLAIN;username=hive;password=hive-secret"} {
+		p, _ := ParseUrl("hive2://" + addr + "/default;socketTimeout=100" + params)
+		start := time.Now()
+		_, err := NewConnector(p).Connect(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("%s: expected a timeout, got %v", params, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: socketTimeout took %v", params, elapsed)
+		}
+	}
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	addr := silentListener(t)
+	for _, params := range []string{";auth=noSasl", ";saslMechanism=PLAIN;username=hive;password=hive-secret"} {
+		p, _ := ParseUrl("hive2://" + addr + "/default" + params)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := NewConnector(p).Connect(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected a deadline error, got %v", params, err)
+		}
+	}
+}
+
+func TestDialParams(t *testing.T) {
+	server := startFakeServer(t, newFakeHive())
+	for _, params := range []string{";socketKeepAlive=true", ";socketKeepAlive=false;connectTimeout=1000;socketTimeout=1000"} {
+		p, _ := ParseUrl("hive2://" + server.addr() + "/default;auth=noSasl" + params)
+		conn, err := NewConnector(p).Connect(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", params, err)
+		}
+		conn.Close()
+	}
+	for _, params := range []string{";connectTimeout=soon", ";socketTimeout=-1", ";socketKeepAlive=maybe"} {
+		p, _ := ParseUrl("hive2://" + server.addr() + "/default;auth=noSasl" + params)
+		if _, err := NewConnector(p).Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%s: expected an error, got %v", params, err)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package hive2
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// fakeServer serves a TCLIService handler over plain sockets, one goroutine per
+// connection, so that tests can exercise the driver without a HiveServer2.
+type fakeServer struct {
+	listener         net.Listener
+	handler          tcliservice.TCLIService
+	transportFactory thrift.TTransportFactory
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func startFakeServer(t *testing.T, handler tcliservice.TCLIService) *fakeServer {
+	return startFakeServerWithTransport(t, handler, thrift.NewTTransportFactory())
+}
+
+func startFakeServerWithTransport(t *testing.T, handler tcliservice.TCLIService, factory thrift.TTransportFactory) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		listener:         l,
+		handler:          handler,
+		transportFactory: factory,
+		conns:            map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.stop)
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	transport, err := s.transportFactory.GetTransport(thrift.NewTSocketFromConnConf(conn, &thrift.TConfiguration{}))
+	if err != nil {
+		return
+	}
+	protocol := thrift.NewTBinaryProtocolConf(transport, &thrift.TConfiguration{})
+	processor := tcliservice.NewTCLIServiceProcessor(s.handler)
+	if old, ok := s.handler.(interface{ unknownMethods() []string }); ok {
+		for _, name := range old.unknownMethods() {
+			delete(processor.ProcessorMap(), name)
+		}
+	}
+	for {
+		ok, err := processor.Process(context.Background(), protocol, protocol)
+		// Like HiveServer2, keep serving after answering with an exception.
+		var appErr thrift.TApplicationException
+		if errors.As(err, &appErr) {
+			continue
+		}
+		if !ok || err != nil {
+			return
+		}
+	}
+}
+
+// dropConnections closes every open client connection, as a restarting server would.
+func (s *fakeServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeServer) stop() {
+	s.listener.Close()
+	s.dropConnections()
+	s.wg.Wait()
+}
+
+func newHandle() *tcliservice.THandleIdentifier {
+	guid := make([]byte, 16)
+	secret := make([]byte, 16)
+	_, _ = rand.Read(guid)
+	_, _ = rand.Read(secret)
+	return &tcliservice.THandleIdentifier{GUID: guid, Secret: secret}
+}
+
+func successStatus() *tcliservice.TStatus {
+	return &tcliservice.TStatus{StatusCode: tcliservice.TStatusCode_SUCCESS_STATUS}
+}
+
+func errorStatus(msg string) *tcliservice.TStatus {
+	return &tcliservice.TStatus{StatusCode: tcliservice.TStatusCode_ERROR_STATUS, ErrorMessage: &msg}
+}
+
+// fakeHive implements the subset of TCLIService used by the driver; calling any other
+// method panics through the nil embedded interface.
+type fakeHive struct {
+	tcliservice.TCLIService
+
+	mu         sync.Mutex
+	protocol   tcliservice.TProtocolVersion
+	sessions   map[string]bool
+	openReqs   []*tcliservice.TOpenSessionReq
+	tokens     map[string]string
+	results    map[string]*fakeResult
+	statements []string
+	overlays   []map[string]string
+	async      []bool
+	operations map[string]*fakeResult
+	// queryIDCalls and metadataCalls count the GetQueryId and GetResultSetMetadata calls.
+	queryIDCalls  int
+	metadataCalls int
+	// cancelCalls counts the operations cancelled.
+	cancelCalls int
+	// clientInfo holds the SetClientInfo calls; missing lists the methods the server
+	// does not know, as an older HiveServer2.
+	clientInfo []map[string]string
+	missing    []string
+}
+
+// fakeResult is the result of a statement: string columns, or no result set when
+// columns is empty.
+type fakeResult struct {
+	columns []string
+	// types are the types of the columns, STRING when nil. Values of INT, BIGINT,
+	// BOOLEAN and DOUBLE columns are sent as such; fakeNull is a NULL.
+	types []tcliservice.TTypeId
+	rows  [][]string
+	// modified is reported as numModifiedRows by servers speaking V11.
+	modified int64
+	// running is the number of status polls answered with RUNNING_STATE; cancelled is
+	// set by CancelOperation.
+	running   int
+	cancelled bool
+	// failure fails the statement with this error message.
+	failure string
+}
+
+// fakeNull stands for NULL in the rows of a fakeResult.
+const fakeNull = "\x00NULL"
+
+func (r *fakeResult) columnType(i int) tcliservice.TTypeId {
+	if i < len(r.types) {
+		return r.types[i]
+	}
+	return tcliservice.TTypeId_STRING_TYPE
+}
+
+// fakeColumn returns column i of rows as a column of type typ.
+func fakeColumn(typ tcliservice.TTypeId, rows [][]string, i int) *tcliservice.TColumn {
+	nulls := make([]byte, (len(rows)+7)/8)
+	for j, row := range rows {
+		if row[i] == fakeNull {
+			nulls[j/8] |= 1 << (j % 8)
+		}
+	}
+	switch typ {
+	case tcliservice.TTypeId_INT_TYPE:
+		column := &tcliservice.TI32Column{Values: []int32{}, Nulls: nulls}
+		for _, row := range rows {
+			n, _ := strconv.ParseInt(row[i], 10, 32)
+			column.Values = append(column.Values, int32(n))
+		}
+		return &tcliservice.TColumn{I32Val: column}
+	case tcliservice.TTypeId_BIGINT_TYPE:
+		column := &tcliservice.TI64Column{Values: []int64{}, Nulls: nulls}
+		for _, row := range rows {
+			n, _ := strconv.ParseInt(row[i], 10, 64)
+			column.Values = append(column.Values, n)
+		}
+		return &tcliservice.TColumn{I64Val: column}
+	case tcliservice.TTypeId_BOOLEAN_TYPE:
+		column := &tcliservice.TBoolColumn{Values: []bool{}, Nulls: nulls}
+		for _, row := range rows {
+			column.Values = append(column.Values, row[i] == "true")
+		}
+		return &tcliservice.TColumn{BoolVal: column}
+	case tcliservice.TTypeId_DOUBLE_TYPE:
+		column := &tcliservice.TDoubleColumn{Values: []float64{}, Nulls: nulls}
+		for _, row := range rows {
+			f, _ := strconv.ParseFloat(row[i], 64)
+			column.Values = append(column.Values, f)
+		}
+		return &tcliservice.TColumn{DoubleVal: column}
+	}
+	column := &tcliservice.TStringColumn{Values: []string{}, Nulls: nulls}
+	for _, row := range rows {
+		column.Values = append(column.Values, row[i])
+	}
+	return &tcliservice.TColumn{StringVal: column}
+}
+
+func newFakeHive() *fakeHive {
+	return &fakeHive{
+		protocol:   tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V8,
+		sessions:   map[string]bool{},
+		tokens:     map[string]string{},
+		results:    map[string]*fakeResult{},
+		operations: map[string]*fakeResult{},
+	}
+}
+
+func (f *fakeHive) unknownMethods() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.missing
+}
+
+// setResult makes statement return result.
+func (f *fakeHive) setResult(statement string, result *fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[statement] = result
+}
+
+// executed returns the statements run so far.
+func (f *fakeHive) executed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.statements...)
+}
+
+func (f *fakeHive) operation(h *tcliservice.TOperationHandle) (*fakeResult, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result, ok := f.operations[string(h.GetOperationId().GetGUID())]
+	return result, ok
+}
+
+func (f *fakeHive) validSession(h *tcliservice.TSessionHandle) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return h != nil && f.sessions[string(h.GetSessionId().GetGUID())]
+}
+
+// expireSessions forgets every session and its operations, as a restarted server would.
+func (f *fakeHive) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions = map[string]bool{}
+	f.operations = map[string]*fakeResult{}
+}
+
+// opened returns the number of sessions opened so far.
+func (f *fakeHive) opened() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.openReqs)
+}
+
+func (f *fakeHive) GetInfo(_ context.Context, req *tcliservice.TGetInfoReq) (*tcliservice.TGetInfoResp, error) {
+	// InfoValue is a required field, even in errors.
+	name := ""
+	if !f.validSession(req.GetSessionHandle()) {
+		return &tcliservice.TGetInfoResp{Status: errorStatus("Invalid SessionHandle"), InfoValue: &tcliservice.TGetInfoValue{StringValue: &name}}, nil
+	}
+	name = "Hive"
+	return &tcliservice.TGetInfoResp{Status: successStatus(), InfoValue: &tcliservice.TGetInfoValue{StringValue: &name}}, nil
+}
+
+func (f *fakeHive) OpenSession(_ context.Context, req *tcliservice.TOpenSessionReq) (*tcliservice.TOpenSessionResp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	handle := &tcliservice.TSessionHandle{SessionId: newHandle()}
+	f.sessions[string(handle.SessionId.GUID)] = true
+	f.openReqs = append(f.openReqs, req)
+	return &tcliservice.TOpenSessionResp{
+		Status:                successStatus(),
+		ServerProtocolVersion: f.protocol,
+		SessionHandle:         handle,
+	}, nil
+}
+
+func (f *fakeHive) CloseSession(_ context.Context, req *tcliservice.TCloseSessionReq) (*tcliservice.TCloseSessionResp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, string(req.GetSessionHandle().GetSessionId().GetGUID()))
+	return &tcliservice.TCloseSessionResp{Status: successStatus()}, nil
+}
+
+func (f *fakeHive) GetDelegationToken(_ context.Context, req *tcliservice.TGetDelegationTokenReq) (*tcliservice.TGetDelegationTokenResp, error) {
+	if !f.validSession(req.GetSessionHandle()) {
+		return &tcliservice.TGetDelegationTokenResp{Status: errorStatus("Invalid SessionHandle")}, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token := "token-" + req.GetOwner() + "-" + req.GetRenewer()
+	f.tokens[token] = "issued"
+	return &tcliservice.TGetDelegationTokenResp{Status: successStatus(), DelegationToken: &token}, nil
+}
+
+func (f *fakeHive) RenewDelegationToken(_ context.Context, req *tcliservice.TRenewDelegationTokenReq) (*tcliservice.TRenewDelegationTokenResp, error) {
+	if !f.validSession(req.GetSessionHandle()) {
+		return &tcliservice.TRenewDelegationTokenResp{Status: errorStatus("Invalid SessionHandle")}, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.tokens[req.GetDelegationToken()]; !ok {
+		return &tcliservice.TRenewDelegationTokenResp{Status: errorStatus("token not found")}, nil
+	}
+	f.tokens[req.GetDelegationToken()] = "renewed"
+	return &tcliservice.TRenewDelegationTokenResp{Status: successStatus()}, nil
+}
+
+func (f *fakeHive) CancelDelegationToken(_ context.Context, req *tcliservice.TCancelDelegationTokenReq) (*tcliservice.TCancelDelegationTokenResp, error) {
+	if !f.validSession(req.GetSessionHandle()) {
+		return &tcliservice.TCancelDelegationTokenResp{Status: errorStatus("Invalid SessionHandle")}, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.tokens[req.GetDelegationToken()]; !ok {
+		return &tcliservice.TCancelDelegationTokenResp{Status: errorStatus("token not found")}, nil
+	}
+	delete(f.tokens, req.GetDelegationToken())
+	return &tcliservice.TCancelDelegationTokenResp{Status: successStatus()}, nil
+}
+
+func (f *fakeHive) ExecuteStatement(_ context.Context, req *tcliservice.TExecuteStatementReq) (*tcliservice.TExecuteStatementResp, error) {
+	if !f.validSession(req.GetSessionHandle()) {
+		return &tcliservice.TExecuteStatementResp{Status: errorStatus("Invalid SessionHandle")}, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, req.GetStatement())
+	f.overlays = append(f.overlays, req.GetConfOverlay())
+	f.async = append(f.async, req.GetRunAsync())
+	result := &fakeResult{}
+	if r := f.results[req.GetStatement()]; r != nil {
+		// Each operation gets its own state.
+		*result = *r
+	}
+	handle := &tcliservice.TOperationHandle{
+		OperationId:   newHandle(),
+		OperationType: tcliservice.TOperationType_EXECUTE_STATEMENT,
+		HasResultSet:  len(result.columns) > 0,
+	}
+	f.operations[string(handle.OperationId.GUID)] = result
+	return &tcliservice.TExecuteStatementResp{Status: successStatus(), OperationHandle: handle}, nil
+}
+
+func (f *fakeHive) GetOperationStatus(_ context.Context, req *tcliservice.TGetOperationStatusReq) (*tcliservice.TGetOperationStatusResp, error) {
+	result, ok := f.operation(req.GetOperationHandle())
+	if !ok {
+		return &tcliservice.TGetOperationStatusResp{Status: errorStatus("Invalid OperationHandle")}, nil
+	}
+	f.mu.Lock()
+	state := tcliservice.TOperationState_FINISHED_STATE
+	switch {
+	case result.failure != "":
+		state = tcliservice.TOperationState_ERROR_STATE
+	case result.cancelled:
+		state = tcliservice.TOperationState_CANCELED_STATE
+	case result.running > 0:
+		state = tcliservice.TOperationState_RUNNING_STATE
+		result.running--
+	}
+	f.mu.Unlock()
+	resp := &tcliservice.TGetOperationStatusResp{Status: successStatus(), OperationState: &state}
+	if result.failure != "" {
+		resp.ErrorMessage = &result.failure
+	}
+	if f.protocol >= tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11 {
+		resp.NumModifiedRows = &result.modified
+	}
+	if req.GetGetProgressUpdate() {
+		resp.ProgressUpdateResponse = &tcliservice.TProgressUpdateResp{
+			HeaderNames:          []string{"VERTICES", "STATUS"},
+			Rows:                 [][]string{{"Map 1", "SUCCEEDED"}},
+			ProgressedPercentage: 1,
+			Status:               tcliservice.TJobExecutionStatus_COMPLETE,
+			FooterSummary:        "VERTICES: 01/01",
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeHive) GetResultSetMetadata(_ context.Context, req *tcliservice.TGetResultSetMetadataReq) (*tcliservice.TGetResultSetMetadataResp, error) {
+	result, ok := f.operation(req.GetOperationHandle())
+	if !ok {
+		return &tcliservice.TGetResultSetMetadataResp{Status: errorStatus("Invalid OperationHandle")}, nil
+	}
+	f.mu.Lock()
+	f.metadataCalls++
+	f.mu.Unlock()
+	schema := &tcliservice.TTableSchema{}
+	for i, name := range result.columns {
+		schema.Columns = append(schema.Columns, &tcliservice.TColumnDesc{
+			ColumnName: name,
+			TypeDesc: &tcliservice.TTypeDesc{Types: []*tcliservice.TTypeEntry{{
+				PrimitiveEntry: &tcliservice.TPrimitiveTypeEntry{Type: result.columnType(i)},
+			}}},
+			Position: int32(i + 1),
+		})
+	}
+	return &tcliservice.TGetResultSetMetadataResp{Status: successStatus(), Schema: schema}, nil
+}
+
+// FetchResults returns all rows on the first FETCH_NEXT and none afterwards.
+func (f *fakeHive) FetchResults(_ context.Context, req *tcliservice.TFetchResultsReq) (*tcliservice.TFetchResultsResp, error) {
+	result, ok := f.operation(req.GetOperationHandle())
+	if !ok {
+		return &tcliservice.TFetchResultsResp{Status: errorStatus("Invalid OperationHandle")}, nil
+	}
+	f.mu.Lock()
+	rows := result.rows
+	if req.GetOrientation() == tcliservice.TFetchOrientation_FETCH_NEXT {
+		f.operations[string(req.GetOperationHandle().GetOperationId().GetGUID())] = &fakeResult{columns: result.columns, types: result.types}
+	}
+	f.mu.Unlock()
+	rowSet := &tcliservice.TRowSet{Rows: []*tcliservice.TRow{}}
+	if f.protocol < tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V6 {
+		for _, row := range rows {
+			tRow := &tcliservice.TRow{}
+			for i := range row {
+				tRow.ColVals = append(tRow.ColVals, &tcliservice.TColumnValue{StringVal: &tcliservice.TStringValue{Value: &row[i]}})
+			}
+			rowSet.Rows = append(rowSet.Rows, tRow)
+		}
+		hasMoreRows := false
+		return &tcliservice.TFetchResultsResp{Status: successStatus(), HasMoreRows: &hasMoreRows, Results: rowSet}, nil
+	}
+	for i := range result.columns {
+		rowSet.Columns = append(rowSet.Columns, fakeColumn(result.columnType(i), rows, i))
+	}
+	hasMoreRows := false
+	return &tcliservice.TFetchResultsResp{Status: successStatus(), HasMoreRows: &hasMoreRows, Results: rowSet}, nil
+}
+
+func (f *fakeHive) GetQueryId(_ context.Context, req *tcliservice.TGetQueryIdReq) (*tcliservice.TGetQueryIdResp, error) {
+	if _, ok := f.operation(req.GetOperationHandle()); !ok {
+		return nil, thrift.NewTApplicationException(thrift.INTERNAL_ERROR, "Invalid OperationHandle")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queryIDCalls++
+	return &tcliservice.TGetQueryIdResp{QueryId: "hive_20240101000000_query"}, nil
+}
+
+func (f *fakeHive) SetClientInfo(_ context.Context, req *tcliservice.TSetClientInfoReq) (*tcliservice.TSetClientInfoResp, error) {
+	if !f.validSession(req.GetSessionHandle()) {
+		return &tcliservice.TSetClientInfoResp{Status: errorStatus("Invalid SessionHandle")}, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clientInfo = append(f.clientInfo, req.GetConfiguration())
+	return &tcliservice.TSetClientInfoResp{Status: successStatus()}, nil
+}
+
+func (f *fakeHive) CancelOperation(_ context.Context, req *tcliservice.TCancelOperationReq) (*tcliservice.TCancelOperationResp, error) {
+	result, ok := f.operation(req.GetOperationHandle())
+	if !ok {
+		return &tcliservice.TCancelOperationResp{Status: errorStatus("Invalid OperationHandle")}, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result.cancelled = true
+	f.cancelCalls++
+	return &tcliservice.TCancelOperationResp{Status: successStatus()}, nil
+}
+
+func (f *fakeHive) CloseOperation(_ context.Context, req *tcliservice.TCloseOperationReq) (*tcliservice.TCloseOperationResp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.operations, string(req.GetOperationHandle().GetOperationId().GetGUID()))
+	return &tcliservice.TCloseOperationResp{Status: successStatus()}, nil
+}
+
+// openFakeDB opens a database on s; params are appended to the session variables.
+func openFakeDB(t *testing.T, s *fakeServer, params string) *sql.DB {
+	db, err := sql.Open("hive2", "hive2://"+s.addr()+"/default;auth=noSasl"+params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,130 @@
+package hive2
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPingExpiredSession(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	db := openFakeDB(t, server, "")
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hive.expireSessions()
+	if err := conn.PingContext(ctx); !errors.Is(err, driver.ErrBadConn) {
+		t.Errorf("expected driver.ErrBadConn, got %v", err)
+	}
+	conn.Close()
+
+	// The pool discarded the connection and opens a new session.
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if opened := hive.opened(); opened != 2 {
+		t.Errorf("opened %d sessions, want 2", opened)
+	}
+}
+
+func TestBadConnectionDiscarded(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	db := openFakeDB(t, server, "")
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("create table t (a int)"); err != nil {
+		t.Fatal(err)
+	}
+	server.dropConnections()
+	if _, err := db.Exec("insert into t values (1)"); err == nil {
+		t.Fatal("expected the dropped connection to fail")
+	}
+	if _, err := db.Exec("insert into t values (2)"); err != nil {
+		t.Fatalf("the pool reused the dropped connection: %v", err)
+	}
+
+	// database/sql does not retry a failed Ping, but discards the connection.
+	server.dropConnections()
+	if err := db.Ping(); !errors.Is(err, driver.ErrBadConn) {
+		t.Errorf("expected driver.ErrBadConn, got %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if opened := hive.opened(); opened != 3 {
+		t.Errorf("opened %d sessions, want 3", opened)
+	}
+
+	hive.expireSessions()
+	if _, err := db.Exec("insert into t values (3)"); err == nil {
+		t.Fatal("expected the expired session to fail")
+	}
+	if _, err := db.Exec("insert into t values (4)"); err != nil {
+		t.Fatalf("the pool reused the expired session: %v", err)
+	}
+}
+
+func TestReopenExpiredSession(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	db := openFakeDB(t, server, ";reopenExpiredSession=true?hive.exec.parallel=true#etl_date=2024-01-01")
+	db.SetMaxOpenConns(1)
+	hive.setResult("select 1", &fakeResult{columns: []string{"_c0"}, rows: [][]string{{"1"}}})
+
+	if _, err := db.Exec("insert into t values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	// A statement the server never started runs again in a new session.
+	hive.expireSessions()
+	if _, err := db.Exec("insert into t values (2)"); err != nil {
+		t.Fatal(err)
+	}
+	if opened := hive.opened(); opened != 2 {
+		t.Fatalf("opened %d sessions, want 2", opened)
+	}
+	hive.mu.Lock()
+	first, second := hive.openReqs[0].GetConfiguration(), hive.openReqs[1].GetConfiguration()
+	hive.mu.Unlock()
+	for _, key := range []string{"use:database", "set:hiveconf:hive.exec.parallel", "set:hivevar:etl_date"} {
+		if first[key] == "" || second[key] != first[key] {
+			t.Errorf("%s = %q in the new session, %q in the first", key, second[key], first[key])
+		}
+	}
+
+	// A started statement is not run again, but the next one gets a new session.
+	rows, err := db.Query("select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hive.expireSessions()
+	if rows.Next() {
+		t.Error("expected the expired query to fail")
+	}
+	rows.Close()
+	if _, err := db.Exec("insert into t values (3)"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"insert into t values (1)", "insert into t values (2)", "select 1", "insert into t values (3)"}
+	if executed := hive.executed(); strings.Join(executed, ";") != strings.Join(want, ";") {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+
+	hive.expireSessions()
+	if err := db.Ping(); err != nil {
+		t.Errorf("Ping should reopen the session: %v", err)
+	}
+	if opened := hive.opened(); opened != 4 {
+		t.Errorf("opened %d sessions, want 4", opened)
+	}
+}
@@ -0,0 +1,127 @@
+package hive2
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+// jwtEnvVar is read for the token of auth=jwt connections that give no jwt parameter,
+// as the Hive JDBC driver does.
+const jwtEnvVar = "JWT"
+
+// TokenSource returns a bearer token for auth=jwt connections. It is called again when
+// HiveServer2 rejects the current token, typically because it expired.
+type TokenSource func(ctx context.Context) (string, error)
+
+// openHTTPTransport opens a transportMode=http connection, which posts every Thrift
+// message to https?://host:port/httpPath. socketTimeout bounds each request.
+func (c *connector) openHTTPTransport(opts dialOptions) (thrift.TTransport, error) {
+	scheme := "http"
+	if c.params.SessionVar["ssl"] == "true" {
+		scheme = "https"
+	}
+	path := c.params.SessionVar["httpPath"]
+	if path == "" {
+		path = "cliservice"
+	}
+	url := fmt.Sprintf("%s://%s/%s", scheme, c.params.Addresses[0], strings.TrimPrefix(path, "/"))
+
+	authorize, err := c.httpAuthorization()
+	if err != nil {
+		return nil, err
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = c.dialContext(opts)
+	client := &http.Client{
+		Transport: &httpAuthTransport{
+			base:      base,
+			authorize: authorize,
+		},
+		Timeout: opts.socketTimeout,
+	}
+	return thrift.NewTHttpClientWithOptions(url, thrift.THttpClientOptions{Client: client})
+}
+
+// httpAuthorization returns the function computing the Authorization header: a bearer
+// token for auth=jwt and basic credentials otherwise.
+func (c *connector) httpAuthorization() (func(ctx context.Context, refresh bool) (string, error), error) {
+	if c.params.SessionVar["auth"] != "jwt" {
+		username, password := credentials(c.params.SessionVar)
+		header := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		return func(context.Context, bool) (string, error) {
+			return header, nil
+		}, nil
+	}
+
+	source := c.tokenSource
+	if source == nil {
+		token := c.params.SessionVar["jwt"]
+		if token == "" {
+			token = os.Getenv(jwtEnvVar)
+		}
+		if token == "" {
+			return nil, errors.New("auth=jwt requires the jwt parameter, the JWT environment variable or a token source")
+		}
+		source = func(context.Context) (string, error) {
+			return token, nil
+		}
+	}
+	var mu sync.Mutex
+	var token string
+	return func(ctx context.Context, refresh bool) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token == "" || refresh {
+			t, err := source(ctx)
+			if err != nil {
+				return "", err
+			}
+			token = t
+		}
+		return "Bearer " + token, nil
+	}, nil
+}
+
+// httpAuthTransport sets the Authorization header of every request, and retries a
+// request rejected with 401 Unauthorized once with a refreshed one.
+type httpAuthTransport struct {
+	base      http.RoundTripper
+	authorize func(ctx context.Context, refresh bool) (string, error)
+}
+
+func (t *httpAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.send(req, false)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.GetBody == nil {
+		return resp, err
+	}
+	resp.Body.Close()
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	return t.send(retry, true)
+}
+
+func (t *httpAuthTransport) send(req *http.Request, refresh bool) (*http.Response, error) {
+	header, err := t.authorize(req.Context(), refresh)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	// A RoundTripper must not modify the request it is given.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", header)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,205 @@
+package hive2
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// fakeHTTPServer serves handler at /cliservice, accepting only requests whose
+// Authorization header is in accepted.
+type fakeHTTPServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	accepted map[string]bool
+	headers  []string
+}
+
+func startFakeHTTPServer(t *testing.T, handler tcliservice.TCLIService, accepted ...string) *fakeHTTPServer {
+	s := &fakeHTTPServer{accepted: map[string]bool{}}
+	for _, header := range accepted {
+		s.accepted[header] = true
+	}
+	protocol := thrift.NewTBinaryProtocolFactoryConf(&thrift.TConfiguration{})
+	thriftHandler := thrift.NewThriftHandlerFunc(tcliservice.NewTCLIServiceProcessor(handler), protocol, protocol)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cliservice", func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		s.mu.Lock()
+		s.headers = append(s.headers, header)
+		ok := s.accepted[header]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		thriftHandler(w, r)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeHTTPServer) uri(params string) string {
+	return "hive2://" + strings.TrimPrefix(s.URL, "http://") + "/default;transportMode=http;httpPath=cliservice" + params
+}
+
+func connectHTTP(t *testing.T, s *fakeHTTPServer, params string, opts ...ConnectorOption) error {
+	p, err := ParseUrl(s.uri(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewConnector(p, opts...).Connect(context.Background())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestHTTPTransportBasicAuth(t *testing.T) {
+	s := startFakeHTTPServer(t, newFakeHive(), "Basic aGl2ZTpzZWNyZXQ=", "Basic YW5vbnltb3VzOmFub255bW91cw==")
+	if err := connectHTTP(t, s, ";username=hive;password=secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectHTTP(t, s, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectHTTP(t, s, ";username=hive;password=wrong"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected HTTP 401, got %v", err)
+	}
+}
+
+func TestHTTPTransportJWT(t *testing.T) {
+	s := startFakeHTTPServer(t, newFakeHive(), "Bearer fresh")
+
+	if err := connectHTTP(t, s, ";auth=jwt;jwt=fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectHTTP(t, s, ";auth=jwt;jwt=expired"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected HTTP 401 for a static expired token, got %v", err)
+	}
+
+	setenv(t, jwtEnvVar, "fresh")
+	if err := connectHTTP(t, s, ";auth=jwt"); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, jwtEnvVar, "")
+	if err := connectHTTP(t, s, ";auth=jwt"); err == nil || !strings.Contains(err.Error(), "auth=jwt") {
+		t.Errorf("expected a missing token error, got %v", err)
+	}
+}
+
+func TestHTTPTransportTokenSourceRefresh(t *testing.T) {
+	s := startFakeHTTPServer(t, newFakeHive(), "Bearer token-2")
+
+	var calls int
+	source := func(context.Context) (string, error) {
+		calls++
+		if calls == 1 {
+			return "token-1", nil
+		}
+		return "token-2", nil
+	}
+	p, err := ParseUrl(s.uri(";auth=jwt;jwt=ignored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewConnector(p, WithTokenSource(source)).Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Later requests keep the refreshed token without asking again.
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("token source called %d times, want 2", calls)
+	}
+	want := []string{"Bearer token-1", "Bearer token-2", "Bearer token-2"}
+	if strings.Join(s.headers, ",") != strings.Join(want, ",") {
+		t.Errorf("Authorization headers = %v, want %v", s.headers, want)
+	}
+
+	failing := func(context.Context) (string, error) {
+		return "", errors.New("identity provider unavailable")
+	}
+	if err := connectHTTP(t, s, ";auth=jwt", WithTokenSource(failing)); err == nil || !strings.Contains(err.Error(), "identity provider unavailable") {
+		t.Errorf("expected the token source error, got %v", err)
+	}
+}
+
+func TestHTTPTransportOutlivesConnectContext(t *testing.T) {
+	s := startFakeHTTPServer(t, newFakeHive(), "Basic aGl2ZTpzZWNyZXQ=")
+	p, err := ParseUrl(s.uri(";username=hive;password=secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := NewConnector(p).Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// database/sql dials with the context of the first statement, and pools the
+	// connection once that statement is done.
+	cancel()
+	stmt, err := conn.Prepare("select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(nil); err != nil {
+		t.Fatalf("Exec after the connect context was cancelled: %v", err)
+	}
+	if err := stmt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowStatusHive answers GetOperationStatus after a delay.
+type slowStatusHive struct {
+	*fakeHive
+	delay time.Duration
+}
+
+func (s slowStatusHive) GetOperationStatus(ctx context.Context, req *tcliservice.TGetOperationStatusReq) (*tcliservice.TGetOperationStatusResp, error) {
+	time.Sleep(s.delay)
+	return s.fakeHive.GetOperationStatus(ctx, req)
+}
+
+func TestHTTPTransportCancelledRPC(t *testing.T) {
+	s := startFakeHTTPServer(t, slowStatusHive{newFakeHive(), time.Second}, "Basic aGl2ZTpzZWNyZXQ=")
+	p, err := ParseUrl(s.uri(";username=hive;password=secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewConnector(p).Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare("select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := stmt.(driver.StmtExecContext).ExecContext(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if conn.(driver.Validator).IsValid() {
+		t.Error("a connection whose RPC was interrupted should not be reused")
+	}
+}
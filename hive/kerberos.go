@@ -0,0 +1,370 @@
+package hive2
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	krb "github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// hostPlaceholder is replaced by the canonical name of the server host, the same way
+// Hadoop's SecurityUtil.getServerPrincipal does.
+const hostPlaceholder = "_HOST"
+
+var (
+	lookupHost = net.LookupHost
+	lookupAddr = net.LookupAddr
+)
+
+// kerberosPrincipal is a parsed principal of the form primary[/instance][@REALM].
+type kerberosPrincipal struct {
+	primary  string
+	instance string
+	realm    string
+}
+
+func parsePrincipal(principal string) (kerberosPrincipal, error) {
+	var p kerberosPrincipal
+	name := principal
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		p.realm = name[i+1:]
+		name = name[:i]
+		if p.realm == "" {
+			return p, fmt.Errorf("invalid kerberos principal %q: empty realm", principal)
+		}
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		p.instance = name[i+1:]
+		name = name[:i]
+		if p.instance == "" || strings.Contains(p.instance, "/") {
+			return p, fmt.Errorf("invalid kerberos principal %q: bad instance", principal)
+		}
+	}
+	p.primary = name
+	if p.primary == "" {
+		return p, fmt.Errorf("invalid kerberos principal %q: empty primary", principal)
+	}
+	return p, nil
+}
+
+// username returns the principal without its realm, which is what gokrb5 expects.
+func (p kerberosPrincipal) username() string {
+	if p.instance == "" {
+		return p.primary
+	}
+	return p.primary + "/" + p.instance
+}
+
+func (p kerberosPrincipal) String() string {
+	s := p.username()
+	if p.realm != "" {
+		s += "@" + p.realm
+	}
+	return s
+}
+
+// normalizeHostName lower-cases a DNS name and strips the trailing dot returned by
+// reverse lookups, so that it can be used as a service principal instance.
+func normalizeHostName(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// canonicalHostName resolves host to its canonical name through a reverse lookup of its
+// address. The host is returned unchanged when it cannot be resolved.
+func canonicalHostName(host string) string {
+	addr := host
+	if net.ParseIP(host) == nil {
+		addrs, err := lookupHost(host)
+		if err != nil || len(addrs) == 0 {
+			return host
+		}
+		addr = addrs[0]
+	}
+	names, err := lookupAddr(addr)
+	if err != nil || len(names) == 0 {
+		return host
+	}
+	return names[0]
+}
+
+// resolveServerPrincipal returns the service principal for a HiveServer2 listening on
+// host. A _HOST instance is replaced by the server host, canonicalized through DNS unless
+// canonicalize is false; other principals are used as they are.
+func resolveServerPrincipal(principal, host string, canonicalize bool) (kerberosPrincipal, error) {
+	p, err := parsePrincipal(principal)
+	if err != nil {
+		return p, err
+	}
+	if p.instance == hostPlaceholder {
+		if host == "" {
+			return p, errors.New("cannot substitute " + hostPlaceholder + " in kerberos principal: unknown server host")
+		}
+		if canonicalize {
+			host = canonicalHostName(host)
+		}
+		p.instance = normalizeHostName(host)
+	} else if p.instance != "" {
+		p.instance = strings.TrimSuffix(p.instance, ".")
+	}
+	return p, nil
+}
+
+// mapServiceRealm makes the krb5 configuration resolve the service host to the realm of
+// the service principal, so that tickets for cross-realm principals are requested from
+// the right KDC.
+func mapServiceRealm(krb5conf *config.Config, service kerberosPrincipal) {
+	if service.realm == "" || krb5conf.ResolveRealm(service.instance) == service.realm {
+		return
+	}
+	if krb5conf.DomainRealm == nil {
+		krb5conf.DomainRealm = config.DomainRealm{}
+	}
+	krb5conf.DomainRealm[service.instance] = service.realm
+}
+
+// kerberosLogin is the part of a gokrb5 client driven by kerberosClient. It is an
+// interface so that the login and renewal logic can be exercised without a KDC.
+type kerberosLogin interface {
+	Login() error
+}
+
+// KerberosTicket describes the ticket granting ticket held by a shared Kerberos client.
+// ExpiresAt and RenewTill are derived from the login time and the ticket_lifetime and
+// renew_lifetime of krb5.conf; the KDC may grant less.
+type KerberosTicket struct {
+	Principal string
+	LoginTime time.Time
+	ExpiresAt time.Time
+	RenewTill time.Time
+	// LoginError is the error of the last login, such as a failed renewal while the
+	// current ticket was still valid.
+	LoginError error
+	// Services are the service tickets the connections requested with the current TGT.
+	Services []KerberosServiceTicket
+}
+
+// KerberosServiceTicket describes a service ticket requested by a connection. It lasts
+// at most ticket_lifetime and never outlives the TGT it was obtained with.
+type KerberosServiceTicket struct {
+	SPN       string
+	StartTime time.Time
+	ExpiresAt time.Time
+	RenewTill time.Time
+}
+
+// kerberosClient is a Kerberos client shared by every connection authenticating as the
+// same principal. It logs in lazily and logs in again from the keytab before the ticket
+// expires; gokrb5 renews the TGT in the background between logins.
+type kerberosClient struct {
+	mu            sync.Mutex
+	principal     string
+	client        *krb.Client
+	login         kerberosLogin
+	lifetime      time.Duration
+	renewLifetime time.Duration
+	loginTime     time.Time
+	expires       time.Time
+	renewTill     time.Time
+	loginErr      error
+	// services maps the SPNs requested since the last login to the time of the request.
+	services map[string]time.Time
+	now      func() time.Time
+}
+
+func newKerberosClient(principal string, client *krb.Client, krb5conf *config.Config) *kerberosClient {
+	kc := &kerberosClient{
+		principal:     principal,
+		client:        client,
+		login:         client,
+		lifetime:      krb5conf.LibDefaults.TicketLifetime,
+		renewLifetime: krb5conf.LibDefaults.RenewLifetime,
+		now:           time.Now,
+	}
+	if kc.lifetime <= 0 {
+		kc.lifetime = 24 * time.Hour
+	}
+	return kc
+}
+
+// ensureLogin logs in when there is no ticket yet or when it is in the last sixth of its
+// lifetime. A failed re-login is tolerated as long as the current ticket is still valid;
+// it is logged and reported by KerberosTickets.
+func (kc *kerberosClient) ensureLogin() error {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	now := kc.now()
+	if !kc.loginTime.IsZero() {
+		if now.Before(kc.expires.Add(-kc.lifetime / 6)) {
+			return nil
+		}
+	}
+	if err := kc.login.Login(); err != nil {
+		kc.loginErr = fmt.Errorf("kerberos login for %s failed: %v", kc.principal, err)
+		if !kc.loginTime.IsZero() && now.Before(kc.expires) {
+			log.Printf("hive2: %v; the current ticket expires at %v", kc.loginErr, kc.expires)
+			return nil
+		}
+		return kc.loginErr
+	}
+	kc.loginTime = now
+	kc.expires = now.Add(kc.lifetime)
+	kc.renewTill = kc.expires
+	if kc.renewLifetime > kc.lifetime {
+		kc.renewTill = now.Add(kc.renewLifetime)
+	}
+	kc.loginErr = nil
+	kc.services = nil
+	return nil
+}
+
+// requestService records that a connection requests a ticket for spn, unless the one
+// requested earlier is still valid.
+func (kc *kerberosClient) requestService(spn string) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	now := kc.now()
+	if start, ok := kc.services[spn]; ok && now.Before(kc.serviceExpiresAt(start)) {
+		return
+	}
+	if kc.services == nil {
+		kc.services = map[string]time.Time{}
+	}
+	kc.services[spn] = now
+}
+
+// serviceExpiresAt must be called with kc.mu held.
+func (kc *kerberosClient) serviceExpiresAt(start time.Time) time.Time {
+	if expires := start.Add(kc.lifetime); expires.Before(kc.expires) {
+		return expires
+	}
+	return kc.expires
+}
+
+func (kc *kerberosClient) ticket() KerberosTicket {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	t := KerberosTicket{
+		Principal:  kc.principal,
+		LoginTime:  kc.loginTime,
+		ExpiresAt:  kc.expires,
+		RenewTill:  kc.renewTill,
+		LoginError: kc.loginErr,
+	}
+	for spn, start := range kc.services {
+		t.Services = append(t.Services, KerberosServiceTicket{
+			SPN:       spn,
+			StartTime: start,
+			ExpiresAt: kc.serviceExpiresAt(start),
+			RenewTill: kc.renewTill,
+		})
+	}
+	sort.Slice(t.Services, func(i, j int) bool { return t.Services[i].SPN < t.Services[j].SPN })
+	return t
+}
+
+var kerberosClients = struct {
+	sync.Mutex
+	m map[string]*kerberosClient
+}{m: map[string]*kerberosClient{}}
+
+// sharedKerberosClient returns the client registered under key, creating it with
+// create on first use.
+func sharedKerberosClient(key string, create func() (*kerberosClient, error)) (*kerberosClient, error) {
+	kerberosClients.Lock()
+	defer kerberosClients.Unlock()
+	if kc, ok := kerberosClients.m[key]; ok {
+		return kc, nil
+	}
+	kc, err := create()
+	if err != nil {
+		return nil, err
+	}
+	kerberosClients.m[key] = kc
+	return kc, nil
+}
+
+var krb5Configs = struct {
+	sync.Mutex
+	m map[string]*config.Config
+}{m: map[string]*config.Config{}}
+
+// krb5Config returns the krb5.conf at path. It is loaded once, when the first connection
+// using it creates its client, rather than on every connection.
+func krb5Config(path string) (*config.Config, error) {
+	krb5Configs.Lock()
+	defer krb5Configs.Unlock()
+	if krb5conf, ok := krb5Configs.m[path]; ok {
+		return krb5conf, nil
+	}
+	krb5conf, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	krb5Configs.m[path] = krb5conf
+	return krb5conf, nil
+}
+
+// withServiceRealm returns a copy of krb5conf mapping the host of service to its realm.
+func withServiceRealm(krb5conf *config.Config, service kerberosPrincipal) *config.Config {
+	c := *krb5conf
+	c.DomainRealm = config.DomainRealm{}
+	for domain, realm := range krb5conf.DomainRealm {
+		c.DomainRealm[domain] = realm
+	}
+	mapServiceRealm(&c, service)
+	return &c
+}
+
+// loadKerberosClient returns the shared client for a principal, keytab and krb5.conf.
+// Cross-realm service principals get a client of their own, with a copy of krb5.conf
+// mapping the service host to its realm.
+func loadKerberosClient(userPrincipal, keytabPath, krb5confPath string, service kerberosPrincipal) (*kerberosClient, error) {
+	krb5conf, err := krb5Config(krb5confPath)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.Join([]string{userPrincipal, keytabPath, krb5confPath}, "\x00")
+	crossRealm := service.realm != "" && krb5conf.ResolveRealm(service.instance) != service.realm
+	if crossRealm {
+		key += "\x00" + service.instance + "@" + service.realm
+	}
+	return sharedKerberosClient(key, func() (*kerberosClient, error) {
+		kt, err := keytab.Load(keytabPath)
+		if err != nil {
+			return nil, err
+		}
+		user, err := parsePrincipal(userPrincipal)
+		if err != nil {
+			return nil, err
+		}
+		if user.realm == "" {
+			user.realm = krb5conf.LibDefaults.DefaultRealm
+		}
+		clientConf := krb5conf
+		if crossRealm {
+			clientConf = withServiceRealm(krb5conf, service)
+		}
+		client := krb.NewWithKeytab(user.username(), user.realm, kt, clientConf)
+		return newKerberosClient(user.String(), client, clientConf), nil
+	})
+}
+
+// KerberosTickets reports the tickets of the Kerberos clients shared by the connections
+// of this process.
+func KerberosTickets() []KerberosTicket {
+	kerberosClients.Lock()
+	defer kerberosClients.Unlock()
+	tickets := make([]KerberosTicket, 0, len(kerberosClients.m))
+	for _, kc := range kerberosClients.m {
+		tickets = append(tickets, kc.ticket())
+	}
+	return tickets
+}
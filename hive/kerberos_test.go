@@ -0,0 +1,312 @@
+package hive2
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/config"
+)
+
+func stubLookups(t *testing.T, hosts map[string][]string, addrs map[string][]string) {
+	origHost, origAddr := lookupHost, lookupAddr
+	t.Cleanup(func() {
+		lookupHost, lookupAddr = origHost, origAddr
+	})
+	lookupHost = func(host string) ([]string, error) {
+		if r, ok := hosts[host]; ok {
+			return r, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	lookupAddr = func(addr string) ([]string, error) {
+		if r, ok := addrs[addr]; ok {
+			return r, nil
+		}
+		return nil, errors.New("no such address")
+	}
+}
+
+func TestParsePrincipal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want kerberosPrincipal
+		err  bool
+	}{
+		{in: "hdfs@HADOOP.COM", want: kerberosPrincipal{primary: "hdfs", realm: "HADOOP.COM"}},
+		{in: "hdfs", want: kerberosPrincipal{primary: "hdfs"}},
+		{in: "hive/_HOST@HADOOP.COM", want: kerberosPrincipal{primary: "hive", instance: "_HOST", realm: "HADOOP.COM"}},
+		{in: "hive/hs2.example.com", want: kerberosPrincipal{primary: "hive", instance: "hs2.example.com"}},
+		{in: "hive/@HADOOP.COM", err: true},
+		{in: "hive/a/b@HADOOP.COM", err: true},
+		{in: "hive@", err: true},
+		{in: "@HADOOP.COM", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePrincipal(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parsePrincipal(%q) expected error, got %+v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePrincipal(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePrincipal(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveServerPrincipal(t *testing.T) {
+	stubLookups(t,
+		map[string][]string{"hs2": {"10.0.0.1"}, "alias.example.com": {"10.0.0.2"}},
+		map[string][]string{"10.0.0.1": {"HS2-01.Example.COM."}, "10.0.0.2": {"wrong.example.com."}},
+	)
+	tests := []struct {
+		name         string
+		principal    string
+		host         string
+		canonicalize bool
+		want         string
+	}{
+		{"host substitution", "hive/_HOST@HADOOP.COM", "hs2", true, "hive/hs2-01.example.com@HADOOP.COM"},
+		{"ip address", "hive/_HOST@HADOOP.COM", "10.0.0.1", true, "hive/hs2-01.example.com@HADOOP.COM"},
+		{"canonicalization disabled", "hive/_HOST@HADOOP.COM", "Alias.Example.com", false, "hive/alias.example.com@HADOOP.COM"},
+		{"unresolvable host", "hive/_HOST@HADOOP.COM", "unknown.example.com", true, "hive/unknown.example.com@HADOOP.COM"},
+		{"explicit host", "hive/hs2.example.com@HADOOP.COM", "alias.example.com", true, "hive/hs2.example.com@HADOOP.COM"},
+		{"explicit host trailing dot", "hive/hs2.example.com.@HADOOP.COM", "hs2", true, "hive/hs2.example.com@HADOOP.COM"},
+		{"cross realm", "hive/_HOST@OTHER.COM", "hs2", true, "hive/hs2-01.example.com@OTHER.COM"},
+		{"no realm", "hive/_HOST", "hs2", true, "hive/hs2-01.example.com"},
+		{"no instance", "hive@HADOOP.COM", "hs2", true, "hive@HADOOP.COM"},
+		{"lower case placeholder", "hive/_host@HADOOP.COM", "hs2", true, "hive/_host@HADOOP.COM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveServerPrincipal(tt.principal, tt.host, tt.canonicalize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("resolveServerPrincipal(%q, %q) = %q, want %q", tt.principal, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMapServiceRealm(t *testing.T) {
+	krb5conf := config.New()
+	krb5conf.DomainRealm[".example.com"] = "HADOOP.COM"
+
+	mapServiceRealm(krb5conf, kerberosPrincipal{primary: "hive", instance: "hs2.example.com", realm: "HADOOP.COM"})
+	if _, ok := krb5conf.DomainRealm["hs2.example.com"]; ok {
+		t.Error("same realm principal should not add a domain_realm mapping")
+	}
+
+	mapServiceRealm(krb5conf, kerberosPrincipal{primary: "hive", instance: "hs2.example.com", realm: "OTHER.COM"})
+	if got := krb5conf.ResolveRealm("hs2.example.com"); got != "OTHER.COM" {
+		t.Errorf("ResolveRealm = %q, want OTHER.COM", got)
+	}
+	if got := krb5conf.ResolveRealm("other.example.com"); got != "HADOOP.COM" {
+		t.Errorf("ResolveRealm = %q, want HADOOP.COM", got)
+	}
+}
+
+type fakeKerberosLogin struct {
+	logins int
+	err    error
+}
+
+func (f *fakeKerberosLogin) Login() error {
+	if f.err != nil {
+		return f.err
+	}
+	f.logins++
+	return nil
+}
+
+func TestKerberosClientRenewal(t *testing.T) {
+	now := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	login := &fakeKerberosLogin{}
+	kc := &kerberosClient{
+		principal:     "hdfs@HADOOP.COM",
+		login:         login,
+		lifetime:      6 * time.Hour,
+		renewLifetime: 7 * 24 * time.Hour,
+		now:           func() time.Time { return now },
+	}
+
+	if got := kc.ticket(); !got.ExpiresAt.IsZero() {
+		t.Errorf("ticket before login = %+v, want no expiry", got)
+	}
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if login.logins != 1 {
+		t.Fatalf("logins = %d, want 1", login.logins)
+	}
+	ticket := kc.ticket()
+	if !ticket.ExpiresAt.Equal(now.Add(6*time.Hour)) || !ticket.RenewTill.Equal(now.Add(7*24*time.Hour)) {
+		t.Errorf("ticket = %+v", ticket)
+	}
+
+	// Still well within the ticket lifetime: the existing TGT is reused.
+	now = now.Add(4 * time.Hour)
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if login.logins != 1 {
+		t.Fatalf("logins = %d, want 1", login.logins)
+	}
+
+	// Close to expiry: log in again from the keytab.
+	now = now.Add(90 * time.Minute)
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if login.logins != 2 {
+		t.Fatalf("logins = %d, want 2", login.logins)
+	}
+	if got := kc.ticket().LoginTime; !got.Equal(now) {
+		t.Errorf("LoginTime = %v, want %v", got, now)
+	}
+
+	// A KDC outage is tolerated while the current ticket is valid...
+	login.err = errors.New("kdc unreachable")
+	now = now.Add(5*time.Hour + 30*time.Minute)
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatalf("ensureLogin with valid ticket: %v", err)
+	}
+	if got := kc.ticket().LoginError; got == nil || !strings.Contains(got.Error(), "kdc unreachable") {
+		t.Errorf("LoginError = %v, want the failed renewal", got)
+	}
+	// ...but reported once it has expired.
+	now = now.Add(time.Hour)
+	if err := kc.ensureLogin(); err == nil {
+		t.Fatal("ensureLogin with expired ticket should fail")
+	}
+
+	login.err = nil
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if login.logins != 3 {
+		t.Fatalf("logins = %d, want 3", login.logins)
+	}
+	if got := kc.ticket().LoginError; got != nil {
+		t.Errorf("LoginError = %v after a successful login", got)
+	}
+}
+
+func TestKerberosServiceTickets(t *testing.T) {
+	now := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	kc := &kerberosClient{
+		principal:     "hdfs@HADOOP.COM",
+		login:         &fakeKerberosLogin{},
+		lifetime:      10 * time.Hour,
+		renewLifetime: 7 * 24 * time.Hour,
+		now:           func() time.Time { return now },
+	}
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(4 * time.Hour)
+	kc.requestService("hive/hs2.example.com")
+	now = now.Add(time.Hour)
+	// The ticket requested earlier is still valid.
+	kc.requestService("hive/hs2.example.com")
+
+	want := []KerberosServiceTicket{{
+		SPN:       "hive/hs2.example.com",
+		StartTime: now.Add(-time.Hour),
+		// The TGT expires before ticket_lifetime has passed.
+		ExpiresAt: now.Add(5 * time.Hour),
+		RenewTill: now.Add(-5*time.Hour + 7*24*time.Hour),
+	}}
+	if got := kc.ticket().Services; !reflect.DeepEqual(got, want) {
+		t.Errorf("Services = %+v, want %+v", got, want)
+	}
+
+	// A new login forgets the tickets obtained with the previous TGT.
+	now = now.Add(4 * time.Hour)
+	if err := kc.ensureLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if got := kc.ticket().Services; len(got) != 0 {
+		t.Errorf("Services = %+v after a new login", got)
+	}
+}
+
+func TestKrb5ConfigLoadedOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	conf := "[libdefaults]\n default_realm = HADOOP.COM\n"
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		krb5Configs.Lock()
+		delete(krb5Configs.m, path)
+		krb5Configs.Unlock()
+	})
+	first, err := krb5Config(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	second, err := krb5Config(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || first.LibDefaults.DefaultRealm != "HADOOP.COM" {
+		t.Error("krb5.conf should be loaded once")
+	}
+
+	mapped := withServiceRealm(first, kerberosPrincipal{primary: "hive", instance: "hs2.other.com", realm: "OTHER.COM"})
+	if mapped.ResolveRealm("hs2.other.com") != "OTHER.COM" || first.ResolveRealm("hs2.other.com") == "OTHER.COM" {
+		t.Error("withServiceRealm should map a copy of the configuration")
+	}
+}
+
+func TestSharedKerberosClient(t *testing.T) {
+	created := 0
+	create := func() (*kerberosClient, error) {
+		created++
+		return &kerberosClient{principal: "hive-test@HADOOP.COM", login: &fakeKerberosLogin{}, lifetime: time.Hour, now: time.Now}, nil
+	}
+	t.Cleanup(func() {
+		kerberosClients.Lock()
+		delete(kerberosClients.m, "shared-test")
+		kerberosClients.Unlock()
+	})
+
+	first, err := sharedKerberosClient("shared-test", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sharedKerberosClient("shared-test", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || created != 1 {
+		t.Fatalf("expected a single shared client, created %d", created)
+	}
+
+	found := false
+	for _, ticket := range KerberosTickets() {
+		if ticket.Principal == "hive-test@HADOOP.COM" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("KerberosTickets did not report the shared client")
+	}
+}
@@ -0,0 +1,199 @@
+package hive2
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// OperationHandle identifies a statement started by Submit. It encodes with encoding/json,
+// so that another process can poll, fetch or cancel the statement through a connection to
+// the same HiveServer2.
+type OperationHandle struct {
+	SessionID       []byte `json:"sessionId"`
+	SessionSecret   []byte `json:"sessionSecret"`
+	OperationID     []byte `json:"operationId"`
+	OperationSecret []byte `json:"operationSecret"`
+	HasResultSet    bool   `json:"hasResultSet"`
+}
+
+func (h *OperationHandle) session() *tcliservice.TSessionHandle {
+	return &tcliservice.TSessionHandle{
+		SessionId: &tcliservice.THandleIdentifier{GUID: h.SessionID, Secret: h.SessionSecret},
+	}
+}
+
+func (h *OperationHandle) operation() *tcliservice.TOperationHandle {
+	return &tcliservice.TOperationHandle{
+		OperationId:   &tcliservice.THandleIdentifier{GUID: h.OperationID, Secret: h.OperationSecret},
+		OperationType: tcliservice.TOperationType_EXECUTE_STATEMENT,
+		HasResultSet:  h.HasResultSet,
+	}
+}
+
+// OperationStatus is the state of a statement started by Submit.
+type OperationStatus struct {
+	// State is the state HiveServer2 reports, such as RUNNING_STATE or FINISHED_STATE.
+	State string
+	// Done is set once the statement finished, failed or was cancelled.
+	Done bool
+	// Err is the error of a statement that failed, was cancelled or timed out.
+	Err error
+	// ModifiedRows is the number of rows the finished statement modified, -1 when the
+	// server does not tell.
+	ModifiedRows int64
+}
+
+// Submit starts query without waiting for it, in a session of its own opened through
+// conn with the connection parameters, and with the settings of WithConf in ctx. The
+// session outlives conn, so that the statement keeps running after the process exits.
+//
+// The caller owns the session: closing conn or the rows of WithOperation leaves it open,
+// and only CloseOperation, or Close on the handle, closes it. A handle that is dropped
+// without being closed keeps its session on the server until the server's idle session
+// timeout, hive.server2.idle.session.timeout, expires it.
+func Submit(ctx context.Context, conn *sql.Conn, query string) (handle *OperationHandle, err error) {
+	err = withHiveConn(conn, func(hc *hiveConn) error {
+		openResp, err := hc.openSession(ctx)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		session := openResp.GetSessionHandle()
+		// The session is only handed over with the statement; any failure closes it.
+		keepSession := false
+		defer func() {
+			if !keepSession {
+				closeReq := tcliservice.NewTCloseSessionReq()
+				closeReq.SessionHandle = session
+				_, _ = hc.client.CloseSession(context.Background(), closeReq)
+			}
+		}()
+		execReq := tcliservice.NewTExecuteStatementReq()
+		execReq.SessionHandle = session
+		execReq.Statement = query
+		execReq.ConfOverlay = confFromContext(ctx)
+		execReq.RunAsync = true
+		execResp, err := hc.client.ExecuteStatement(ctx, execReq)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(execResp.GetStatus()) {
+			return fmt.Errorf("Error from server: %s ", execResp.GetStatus().String())
+		}
+		op := execResp.GetOperationHandle()
+		handle = &OperationHandle{
+			SessionID:       session.GetSessionId().GetGUID(),
+			SessionSecret:   session.GetSessionId().GetSecret(),
+			OperationID:     op.GetOperationId().GetGUID(),
+			OperationSecret: op.GetOperationId().GetSecret(),
+			HasResultSet:    op.GetHasResultSet(),
+		}
+		keepSession = true
+		return nil
+	})
+	return handle, err
+}
+
+// The functions taking a handle report the server's errors without marking conn bad, as
+// they concern the session of the handle rather than the one of conn.
+
+// Status polls the state of the statement of handle through conn.
+func Status(ctx context.Context, conn *sql.Conn, handle *OperationHandle) (status *OperationStatus, err error) {
+	err = withHiveConn(conn, func(hc *hiveConn) error {
+		req := tcliservice.NewTGetOperationStatusReq()
+		req.OperationHandle = handle.operation()
+		resp, err := hc.client.GetOperationStatus(ctx, req)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return fmt.Errorf("Error from server: %s ", resp.GetStatus().String())
+		}
+		status = &OperationStatus{
+			State:        resp.GetOperationState().String(),
+			Err:          operationError(resp),
+			ModifiedRows: hc.modifiedRows(resp),
+		}
+		status.Done = status.Err != nil || operationFinished(resp)
+		return nil
+	})
+	return status, err
+}
+
+// Cancel cancels the statement of handle through conn.
+func Cancel(ctx context.Context, conn *sql.Conn, handle *OperationHandle) error {
+	return withHiveConn(conn, func(hc *hiveConn) error {
+		req := tcliservice.NewTCancelOperationReq()
+		req.OperationHandle = handle.operation()
+		resp, err := hc.client.CancelOperation(ctx, req)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return fmt.Errorf("Error from server: %s ", resp.GetStatus().String())
+		}
+		return nil
+	})
+}
+
+// CloseOperation closes the session Submit opened for handle, and with it the statement
+// and its results.
+func CloseOperation(ctx context.Context, conn *sql.Conn, handle *OperationHandle) error {
+	return withHiveConn(conn, func(hc *hiveConn) error {
+		req := tcliservice.NewTCloseSessionReq()
+		req.SessionHandle = handle.session()
+		resp, err := hc.client.CloseSession(ctx, req)
+		if err != nil {
+			hc.checkError(err)
+			return err
+		}
+		if !verifySuccessWithInfo(resp.GetStatus()) {
+			return fmt.Errorf("Error from server: %s ", resp.GetStatus().String())
+		}
+		return nil
+	})
+}
+
+// Close closes the session Submit opened for the handle through conn, as
+// CloseOperation does.
+func (h *OperationHandle) Close(ctx context.Context, conn *sql.Conn) error {
+	return CloseOperation(ctx, conn, h)
+}
+
+type operationKey struct{}
+
+// WithOperation returns a context that makes QueryContext fetch the results of the
+// statement of handle, waiting for it to finish, instead of running a query; the query
+// passed to QueryContext should be empty. Closing the rows closes the statement, but not
+// the session of handle.
+//
+//	rows, err := conn.QueryContext(hive2.WithOperation(ctx, handle), "")
+func WithOperation(ctx context.Context, handle *OperationHandle) context.Context {
+	return context.WithValue(ctx, operationKey{}, handle)
+}
+
+// attachOperation makes the statement fetch the results of the operation of handle.
+func (hs *hiveStmt) attachOperation(ctx context.Context, handle *OperationHandle) (driver.Rows, error) {
+	if err := hs.closeClientOperation(); err != nil {
+		return nil, err
+	}
+	hs.initFlags()
+	hs.stmtHandle = handle.operation()
+	hr := &hiveRows{
+		hiveStmt: hs,
+		ctx:      ctx,
+	}
+	if hs.stmtHandle.GetHasResultSet() {
+		if err := hr.retrieveSchema(); err != nil {
+			return nil, err
+		}
+	}
+	return hr, nil
+}
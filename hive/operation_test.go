@@ -0,0 +1,162 @@
+package hive2
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRunAsyncParam(t *testing.T) {
+	for _, tt := range []struct {
+		params string
+		want   []bool
+	}{
+		{"", []bool{true}},
+		{";runAsync=false", []bool{false}},
+	} {
+		hive := newFakeHive()
+		db := openFakeDB(t, startFakeServer(t, hive), tt.params)
+		if _, err := db.Exec("insert into t values (1)"); err != nil {
+			t.Fatal(err)
+		}
+		hive.mu.Lock()
+		if !reflect.DeepEqual(hive.async, tt.want) {
+			t.Errorf("%q: runAsync %v, want %v", tt.params, hive.async, tt.want)
+		}
+		hive.mu.Unlock()
+	}
+	db := openFakeDB(t, startFakeServer(t, newFakeHive()), ";runAsync=later")
+	if err := db.Ping(); err == nil {
+		t.Error("expected an invalid runAsync error")
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	hive.setResult("select 1", &fakeResult{columns: []string{"_c0"}, rows: [][]string{{"1"}}, running: 2})
+	ctx := context.Background()
+
+	// One process submits the statement and exits.
+	submitter := openFakeDB(t, server, "")
+	conn, err := submitter.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := Submit(WithQueryTag(ctx, "etl"), conn, "select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	submitter.Close()
+	if !hive.validSession(handle.session()) {
+		t.Fatal("the session of the statement was closed with the connection")
+	}
+
+	// Another one picks it up.
+	var decoded OperationHandle
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	db := openFakeDB(t, server, "")
+	conn, err = db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	status, err := Status(ctx, conn, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Done || status.State != "RUNNING_STATE" {
+		t.Errorf("status %+v, want running", status)
+	}
+	rows, err := conn.QueryContext(WithOperation(ctx, &decoded), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(values, []string{"1"}) {
+		t.Errorf("fetched %v", values)
+	}
+	if err := CloseOperation(ctx, conn, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if hive.validSession(handle.session()) {
+		t.Error("CloseOperation left the session open")
+	}
+	if err := conn.PingContext(ctx); err != nil {
+		t.Errorf("the connection is unusable: %v", err)
+	}
+
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if tag := hive.overlays[0]["hive.query.tag"]; tag != "etl" {
+		t.Errorf("query tag %q", tag)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	hive := newFakeHive()
+	hive.setResult("insert into t select * from s", &fakeResult{running: 100})
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	handle, err := Submit(ctx, conn, "insert into t select * from s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Cancel(ctx, conn, handle); err != nil {
+		t.Fatal(err)
+	}
+	status, err := Status(ctx, conn, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Done || status.Err == nil || status.State != "CANCELED_STATE" {
+		t.Errorf("status %+v, want cancelled", status)
+	}
+	if err := handle.Close(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if hive.validSession(handle.session()) {
+		t.Error("Close left the session open")
+	}
+}
+
+func TestSubmitClosesSessionOnError(t *testing.T) {
+	hive := newFakeHive()
+	hive.missing = []string{"ExecuteStatement"}
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := Submit(ctx, conn, "select 1"); err == nil {
+		t.Fatal("expected the ExecuteStatement error")
+	}
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if len(hive.openReqs) != 2 || len(hive.sessions) != 1 {
+		t.Errorf("%d sessions opened, %d left open, want the one of Submit closed", len(hive.openReqs), len(hive.sessions))
+	}
+}
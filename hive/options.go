@@ -0,0 +1,72 @@
+package hive2
+
+import (
+	"database/sql/driver"
+)
+
+// ConnectorOption configures a connector created by NewConnector. Options take precedence
+// over the equivalent connection parameters.
+type ConnectorOption func(*connector)
+
+// NewConnector returns a connector for params, to be used with sql.OpenDB.
+func NewConnector(params *ConnParams, opts ...ConnectorOption) driver.Connector {
+	c := &connector{
+		params: params,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithSaslMechanism selects the SASL mechanism by the name it is registered under with
+// sasl.Register; PLAIN, GSSAPI, DIGEST-MD5, CRAM-MD5 and SCRAM-SHA-1/256/512 are
+// built in. It overrides the saslMechanism connection parameter.
+func WithSaslMechanism(mechanism string) ConnectorOption {
+	return func(c *connector) {
+		c.mechanism = mechanism
+	}
+}
+
+// WithSaslQop restricts the quality of protection the SASL mechanism may negotiate to
+// qop, any of "auth", "auth-int" and "auth-conf". It overrides the saslQop connection
+// parameter; the connection fails when the mechanism negotiates anything else.
+func WithSaslQop(qop ...string) ConnectorOption {
+	return func(c *connector) {
+		c.qop = qop
+	}
+}
+
+// WithTokenSource supplies the bearer token of auth=jwt connections over the HTTP
+// transport. The source is called for the first request and again whenever HiveServer2
+// answers 401 Unauthorized; it takes precedence over the jwt parameter.
+func WithTokenSource(source TokenSource) ConnectorOption {
+	return func(c *connector) {
+		c.tokenSource = source
+	}
+}
+
+// WithCredentials obtains the user name and password of every new connection from
+// provider instead of the connection parameters, environment or credentials files.
+func WithCredentials(provider CredentialProvider) ConnectorOption {
+	return func(c *connector) {
+		c.credentials = provider
+	}
+}
+
+// WithDialContext opens the connections to HiveServer2 with dial instead of a net.Dialer,
+// for the binary and the HTTP transports alike. The connectTimeout and socketTimeout
+// parameters still apply.
+func WithDialContext(dial DialContextFunc) ConnectorOption {
+	return func(c *connector) {
+		c.dial = dial
+	}
+}
+
+// WithProgress calls fn with the progress of every statement each time the driver polls
+// its status, on servers speaking protocol V10 (Hive 2.3) or later.
+func WithProgress(fn func(Progress)) ConnectorOption {
+	return func(c *connector) {
+		c.progress = fn
+	}
+}
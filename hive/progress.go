@@ -0,0 +1,57 @@
+package hive2
+
+import (
+	"context"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// Progress is the state of a running statement as HiveServer2 reports it, the way
+// beeline prints it: a table of the stages of the query and a summary.
+type Progress struct {
+	// QueryID identifies the statement in the server's logs and web UI; it is empty on
+	// servers older than protocol V11.
+	QueryID string
+	// Percentage of the work done, between 0 and 1.
+	Percentage float64
+	// Status is NOT_AVAILABLE, IN_PROGRESS or COMPLETE.
+	Status  string
+	Headers []string
+	Rows    [][]string
+	Footer  string
+}
+
+// reportProgress passes the progress in resp to the WithProgress function, if any.
+func (hs *hiveStmt) reportProgress(resp *tcliservice.TGetOperationStatusResp) {
+	update := resp.GetProgressUpdateResponse()
+	if hs.hc.progress == nil || update == nil {
+		return
+	}
+	hs.hc.progress(Progress{
+		QueryID:    hs.queryID(),
+		Percentage: update.GetProgressedPercentage(),
+		Status:     update.GetStatus().String(),
+		Headers:    update.GetHeaderNames(),
+		Rows:       update.GetRows(),
+		Footer:     update.GetFooterSummary(),
+	})
+}
+
+// queryID asks the server for the id of the running statement once; it is empty when the
+// server cannot tell.
+func (hs *hiveStmt) queryID() string {
+	if hs.queryIDFetched || !hs.hc.supports(featureQueryID) {
+		return hs.queryIDValue
+	}
+	hs.queryIDFetched = true
+	req := tcliservice.NewTGetQueryIdReq()
+	req.OperationHandle = hs.stmtHandle
+	resp, err := hs.hc.client.GetQueryId(context.Background(), req)
+	if err != nil {
+		// Servers before Hive 3 answer with an unknown method exception.
+		hs.hc.checkError(err)
+		return ""
+	}
+	hs.queryIDValue = resp.GetQueryId()
+	return hs.queryIDValue
+}
@@ -0,0 +1,54 @@
+package hive2
+
+import (
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+// clientProtocol is the highest protocol version the driver speaks. openSession asks for
+// it, and the session uses the version the server answers with when that is lower.
+const clientProtocol = tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11
+
+// feature is a part of the protocol that only servers of some version support.
+type feature int
+
+const (
+	// featureColumnarResults: FetchResults returns columns rather than rows.
+	featureColumnarResults feature = iota
+	// featureProgressUpdates: GetOperationStatus reports the progress of a statement.
+	featureProgressUpdates
+	// featureModifiedRows: GetOperationStatus reports the rows a DML statement modified.
+	featureModifiedRows
+	// featureTimestampLocalTZ: result sets may hold TIMESTAMP WITH LOCAL TIME ZONE columns,
+	// which rows return as time.Time values.
+	featureTimestampLocalTZ
+	// featureQueryID: GetQueryId returns the id of a statement.
+	featureQueryID
+	// featureClientInfo: SetClientInfo labels the session in logs and the web UI.
+	featureClientInfo
+)
+
+// featureVersions is the first protocol version with each feature. numModifiedRows,
+// GetQueryId and SetClientInfo came with Hive 3 and 4 without a new protocol version, so
+// servers speaking V11 may still not support them.
+var featureVersions = map[feature]tcliservice.TProtocolVersion{
+	featureColumnarResults:  tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V6,
+	featureProgressUpdates:  tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V10,
+	featureModifiedRows:     tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11,
+	featureTimestampLocalTZ: tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11,
+	featureQueryID:          tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11,
+	featureClientInfo:       tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11,
+}
+
+// negotiatedProtocol returns the protocol version of a session the server opened with
+// version server.
+func negotiatedProtocol(server tcliservice.TProtocolVersion) tcliservice.TProtocolVersion {
+	if server > clientProtocol {
+		return clientProtocol
+	}
+	return server
+}
+
+// supports reports whether the session's protocol version has f.
+func (hc *hiveConn) supports(f feature) bool {
+	return hc.protocol >= featureVersions[f]
+}
@@ -0,0 +1,177 @@
+package hive2
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+func TestProtocolNegotiation(t *testing.T) {
+	tests := []struct {
+		server   tcliservice.TProtocolVersion
+		progress bool
+		queryID  bool
+	}{
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V1, false, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V5, false, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V6, false, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V7, false, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V8, false, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V9, false, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V10, true, false},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server.String(), func(t *testing.T) {
+			hive := newFakeHive()
+			hive.protocol = tt.server
+			hive.setResult("select 1", &fakeResult{columns: []string{"_c0"}, rows: [][]string{{"1"}}})
+			server := startFakeServer(t, hive)
+			params, err := ParseUrl("hive2://" + server.addr() + "/default;auth=noSasl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var updates []Progress
+			db := sql.OpenDB(NewConnector(params, WithProgress(func(p Progress) {
+				updates = append(updates, p)
+			})))
+			defer db.Close()
+
+			// Row based results before V6, columnar ones since.
+			var v string
+			if err := db.QueryRow("select 1").Scan(&v); err != nil {
+				t.Fatal(err)
+			}
+			if v != "1" {
+				t.Errorf("got %q", v)
+			}
+
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Raw(func(driverConn interface{}) error {
+				if got := driverConn.(*hiveConn).protocol; got != tt.server {
+					t.Errorf("negotiated %v", got)
+				}
+				return nil
+			})
+			hive.mu.Lock()
+			requested, queryIDCalls := hive.openReqs[0].GetClientProtocol(), hive.queryIDCalls
+			hive.mu.Unlock()
+			if got := requested; got != clientProtocol {
+				t.Errorf("client asked for %v", got)
+			}
+			if (len(updates) > 0) != tt.progress {
+				t.Errorf("progress updates: %v", updates)
+			}
+			if tt.progress && updates[0].Percentage != 1 {
+				t.Errorf("progress: %+v", updates[0])
+			}
+			if tt.queryID != (queryIDCalls > 0) {
+				t.Errorf("GetQueryId called %d times", queryIDCalls)
+			}
+			if tt.queryID && updates[0].QueryID != "hive_20240101000000_query" {
+				t.Errorf("query id %q", updates[0].QueryID)
+			}
+		})
+	}
+}
+
+func TestNegotiatedProtocol(t *testing.T) {
+	if got := negotiatedProtocol(clientProtocol + 1); got != clientProtocol {
+		t.Errorf("a newer server should speak %v, got %v", clientProtocol, got)
+	}
+}
+
+func TestTimestampLocalTZ(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		server tcliservice.TProtocolVersion
+		want   interface{}
+	}{
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V10, "2024-01-01 12:00:00.5 Europe/Paris"},
+		{tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11, time.Date(2024, 1, 1, 12, 0, 0, 5e8, paris)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server.String(), func(t *testing.T) {
+			hive := newFakeHive()
+			hive.protocol = tt.server
+			hive.setResult("select ts", &fakeResult{
+				columns: []string{"ts", "plain"},
+				types:   []tcliservice.TTypeId{tcliservice.TTypeId_TIMESTAMPLOCALTZ_TYPE, tcliservice.TTypeId_STRING_TYPE},
+				rows:    [][]string{{"2024-01-01 12:00:00.5 Europe/Paris", "2024-01-01 12:00:00.5 Europe/Paris"}},
+			})
+			db := openFakeDB(t, startFakeServer(t, hive), "")
+			var ts, plain interface{}
+			if err := db.QueryRow("select ts").Scan(&ts, &plain); err != nil {
+				t.Fatal(err)
+			}
+			if want, ok := tt.want.(time.Time); ok {
+				if got, ok := ts.(time.Time); !ok || !got.Equal(want) || got.Location().String() != "Europe/Paris" {
+					t.Errorf("ts = %#v, want %v", ts, want)
+				}
+			} else if ts != tt.want {
+				t.Errorf("ts = %#v, want %q", ts, tt.want)
+			}
+			if _, ok := plain.(string); !ok {
+				t.Errorf("a STRING column was converted to %T", plain)
+			}
+		})
+	}
+}
+
+func TestTimestampLocalTZOffsets(t *testing.T) {
+	tests := []struct {
+		text   string
+		offset int
+	}{
+		{"2024-01-01 12:00:00 +08:00", 8 * 3600},
+		{"2024-01-01 12:00:00 -05:30", -(5*3600 + 30*60)},
+		{"2024-01-01 12:00:00 GMT+08:00", 8 * 3600},
+		{"2024-01-01 12:00:00 UTC+01:00", 3600},
+		{"2024-01-01 12:00:00 Z", 0},
+		{"2024-01-01 12:00:00 GMT", 0},
+	}
+	hive := newFakeHive()
+	hive.protocol = tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	for _, tt := range tests {
+		hive.setResult("select ts", &fakeResult{
+			columns: []string{"ts"},
+			types:   []tcliservice.TTypeId{tcliservice.TTypeId_TIMESTAMPLOCALTZ_TYPE},
+			rows:    [][]string{{tt.text}},
+		})
+		var ts interface{}
+		if err := db.QueryRow("select ts").Scan(&ts); err != nil {
+			t.Fatalf("%q: %v", tt.text, err)
+		}
+		want := time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("", tt.offset))
+		got, ok := ts.(time.Time)
+		if _, offset := got.Zone(); !ok || !got.Equal(want) || offset != tt.offset {
+			t.Errorf("%q: got %#v, want %v", tt.text, ts, want)
+		}
+	}
+
+	// A zone that cannot be resolved leaves the value as text.
+	text := "2024-01-01 12:00:00 Nowhere/Unknown"
+	hive.setResult("select ts", &fakeResult{
+		columns: []string{"ts"},
+		types:   []tcliservice.TTypeId{tcliservice.TTypeId_TIMESTAMPLOCALTZ_TYPE},
+		rows:    [][]string{{text}},
+	})
+	var ts interface{}
+	if err := db.QueryRow("select ts").Scan(&ts); err != nil {
+		t.Fatal(err)
+	}
+	if ts != text {
+		t.Errorf("got %#v, want %q", ts, text)
+	}
+}
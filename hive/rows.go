@@ -5,8 +5,11 @@ import (
 	"context"
 	"database/sql/driver"
 	"errors"
-	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/apache/thrift/lib/go/thrift"
 
@@ -230,7 +233,9 @@ func (rs *colBasedSet) next() []interface{} {
 }
 
 type hiveRows struct {
-	hiveStmt    *hiveStmt
+	hiveStmt *hiveStmt
+	// ctx is the context of the query, used to wait for the statement and fetch its rows.
+	ctx         context.Context
 	columns     []*tcliservice.TColumnDesc
 	columnNames []string
 	fetchedRows rowSetFactory
@@ -241,12 +246,16 @@ type hiveRows struct {
 func (rows *hiveRows) retrieveSchema() error {
 	metadataReq := tcliservice.NewTGetResultSetMetadataReq()
 	metadataReq.OperationHandle = rows.hiveStmt.stmtHandle
-	metadataResp, err := rows.hiveStmt.hc.client.GetResultSetMetadata(rows.hiveStmt.hc.ctx, metadataReq)
+	metadataResp, err := rows.hiveStmt.hc.client.GetResultSetMetadata(rows.ctx, metadataReq)
 	if err != nil {
+		rows.hiveStmt.hc.checkError(err)
+		if rows.ctx.Err() != nil {
+			return rows.ctx.Err()
+		}
 		return err
 	}
 	if !verifySuccess(metadataResp.GetStatus(), false) {
-		return fmt.Errorf("Error from server: %s ", metadataResp.Status.String())
+		return rows.hiveStmt.hc.serverError(metadataResp.Status)
 	}
 	schema := metadataResp.GetSchema()
 	if schema == nil || schema.GetColumns() == nil {
@@ -256,6 +265,9 @@ func (rows *hiveRows) retrieveSchema() error {
 	for _, column := range rows.columns {
 		rows.columnNames = append(rows.columnNames, column.ColumnName)
 	}
+	if rows.hiveStmt.hc.stripPrefix {
+		rows.columnNames = stripColumnPrefixes(rows.columnNames)
+	}
 	return nil
 }
 
@@ -268,9 +280,12 @@ func (rows *hiveRows) Close() error {
 }
 
 func (rows *hiveRows) Next(dest []driver.Value) error {
-	if err := rows.hiveStmt.waitForOperationToComplete(); err != nil {
+	if err := rows.hiveStmt.waitForOperationToComplete(rows.ctx); err != nil {
 		return err
 	}
+	if !rows.hiveStmt.stmtHandle.GetHasResultSet() {
+		return io.EOF
+	}
 	orientation := tcliservice.TFetchOrientation_FETCH_NEXT
 	if rows.fetchFirst {
 		orientation = tcliservice.TFetchOrientation_FETCH_FIRST
@@ -282,15 +297,19 @@ func (rows *hiveRows) Next(dest []driver.Value) error {
 		fetchReq.OperationHandle = rows.hiveStmt.stmtHandle
 		fetchReq.Orientation = orientation
 		fetchReq.MaxRows = rows.hiveStmt.hc.fetchSize
-		fetchResp, err := rows.hiveStmt.hc.client.FetchResults(rows.hiveStmt.hc.ctx, fetchReq)
+		fetchResp, err := rows.hiveStmt.hc.client.FetchResults(rows.ctx, fetchReq)
 		if err != nil {
+			rows.hiveStmt.hc.checkError(err)
+			if rows.ctx.Err() != nil {
+				return rows.ctx.Err()
+			}
 			return err
 		}
 		if !verifySuccessWithInfo(fetchResp.GetStatus()) {
-			return fmt.Errorf("Error from server: %s ", fetchResp.Status.String())
+			return rows.hiveStmt.hc.serverError(fetchResp.Status)
 		}
 		results := fetchResp.GetResults()
-		if rows.hiveStmt.hc.protocol > tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V6 {
+		if rows.hiveStmt.hc.supports(featureColumnarResults) {
 			rowSet := &colBasedSet{
 				tRowSet: results,
 				offset:  0,
@@ -313,8 +332,12 @@ func (rows *hiveRows) Next(dest []driver.Value) error {
 		for i := 0; i < len(dest); i++ {
 			dest[i] = row[i]
 		}
+		if rows.hiveStmt.hc.supports(featureTimestampLocalTZ) {
+			rows.convertLocalTimestamps(dest)
+		}
 	} else {
-		return errors.New("no data")
+		// The server has no more rows.
+		return io.EOF
 	}
 
 	rows.rowsFetched++
@@ -322,6 +345,75 @@ func (rows *hiveRows) Next(dest []driver.Value) error {
 	return nil
 }
 
+// convertLocalTimestamps turns the text HiveServer2 sends for TIMESTAMP WITH LOCAL TIME
+// ZONE columns, such as "2024-01-01 12:00:00.0 Europe/Paris", into time.Time values in
+// their time zone. Values whose time zone cannot be resolved are left as text.
+func (rows *hiveRows) convertLocalTimestamps(dest []driver.Value) {
+	for i, value := range dest {
+		text, ok := value.(string)
+		if !ok || i >= len(rows.columns) {
+			continue
+		}
+		types := rows.columns[i].GetTypeDesc().GetTypes()
+		if len(types) == 0 || types[0].GetPrimitiveEntry().GetType() != tcliservice.TTypeId_TIMESTAMPLOCALTZ_TYPE {
+			continue
+		}
+		if t, ok := parseLocalTimestamp(text); ok {
+			dest[i] = t
+		}
+	}
+}
+
+// parseLocalTimestamp parses a TIMESTAMP WITH LOCAL TIME ZONE value in the time zone it
+// names.
+func parseLocalTimestamp(text string) (time.Time, bool) {
+	fields := strings.Fields(text)
+	if len(fields) != 3 {
+		return time.Time{}, false
+	}
+	location, ok := timeZone(fields[2])
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := parseHiveTime(fields[0] + " " + fields[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), location), true
+}
+
+// timeZone resolves the Java zone ID Hive prints for the session time zone: a region
+// such as Europe/Paris, or a fixed offset such as +08:00, Z, GMT+08:00 or UTC+01:00, which
+// need no time zone database.
+func timeZone(id string) (*time.Location, bool) {
+	offset := id
+	for _, prefix := range []string{"GMT", "UTC", "UT"} {
+		if strings.HasPrefix(offset, prefix) {
+			offset = offset[len(prefix):]
+			break
+		}
+	}
+	if offset == "" || offset == "Z" {
+		return time.FixedZone(id, 0), true
+	}
+	if offset[0] == '+' || offset[0] == '-' {
+		seconds := 0
+		for i, part := range strings.Split(offset[1:], ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil || i > 2 || len(part) != 2 || n > 59 {
+				return nil, false
+			}
+			seconds += n * []int{3600, 60, 1}[i]
+		}
+		if offset[0] == '-' {
+			seconds = -seconds
+		}
+		return time.FixedZone(id, seconds), true
+	}
+	location, err := time.LoadLocation(id)
+	return location, err == nil
+}
+
 func (rows *hiveRows) ColumnTypeDatabaseTypeName(index int) string {
 	return tcliservice.TYPE_NAMES[rows.columns[index].TypeDesc.Types[0].PrimitiveEntry.Type]
 }
@@ -0,0 +1,129 @@
+package hive2
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/mumuhhh/gohive2/sasl"
+	saslcrammd5 "github.com/mumuhhh/gohive2/sasl/crammd5"
+	sasldigest "github.com/mumuhhh/gohive2/sasl/digest"
+	saslgsskerb "github.com/mumuhhh/gohive2/sasl/gsskerb"
+	saslplain "github.com/mumuhhh/gohive2/sasl/plain"
+	saslscram "github.com/mumuhhh/gohive2/sasl/scram"
+)
+
+func init() {
+	sasl.Register("PLAIN", newPlainClient)
+	sasl.Register("CRAM-MD5", newCramMD5Client)
+	sasl.Register("DIGEST-MD5", newDigestMD5Client)
+	sasl.Register("GSSAPI", newGssKerbClient)
+	sasl.Register("SCRAM-SHA-1", newScramClient(saslscram.NewScramSHA1Client))
+	sasl.Register("SCRAM-SHA-256", newScramClient(saslscram.NewScramSHA256Client))
+	sasl.Register("SCRAM-SHA-512", newScramClient(saslscram.NewScramSHA512Client))
+}
+
+var anonymousWarning sync.Once
+
+// credentials returns the user name and password given in the connection parameters,
+// falling back to anonymous like the Hive JDBC driver. The fallback is logged once, as
+// only servers without authentication accept it.
+func credentials(params map[string]string) (string, string) {
+	username, hasUsername := params["username"]
+	password, hasPassword := params["password"]
+	if !hasUsername && !hasPassword {
+		anonymousWarning.Do(func() {
+			log.Print("hive2: no credentials found, logging in as anonymous")
+		})
+	}
+	if !hasUsername {
+		username = "anonymous"
+	}
+	if !hasPassword {
+		password = "anonymous"
+	}
+	return username, password
+}
+
+// passwordCredentials returns the user name and password for mechanism, which verifies
+// the password and so cannot log in as anonymous.
+func passwordCredentials(mechanism string, params map[string]string) (string, string, error) {
+	username, hasUsername := params["username"]
+	password, hasPassword := params["password"]
+	if !hasUsername || !hasPassword {
+		return "", "", fmt.Errorf("%s requires a user name and password: set the username and password parameters, a credentials file or WithCredentials", mechanism)
+	}
+	return username, password, nil
+}
+
+func newPlainClient(params map[string]string, _ string) (sasl.Client, error) {
+	username, password := credentials(params)
+	return saslplain.NewPlainClient("", username, password), nil
+}
+
+func newCramMD5Client(params map[string]string, _ string) (sasl.Client, error) {
+	username, password, err := passwordCredentials("CRAM-MD5", params)
+	if err != nil {
+		return nil, err
+	}
+	return saslcrammd5.NewCramMD5Client(username, password), nil
+}
+
+func newScramClient(newClient func(authorizationID, username, password string) *saslscram.ScramClient) sasl.Factory {
+	return func(params map[string]string, _ string) (sasl.Client, error) {
+		username, password, err := passwordCredentials("SCRAM", params)
+		if err != nil {
+			return nil, err
+		}
+		return newClient("", username, password), nil
+	}
+}
+
+func newDigestMD5Client(params map[string]string, host string) (sasl.Client, error) {
+	if params["auth"] == "delegationToken" {
+		encoded, ok := params["delegationToken"]
+		if !ok {
+			return nil, errors.New("auth=delegationToken requires the delegationToken parameter")
+		}
+		token, err := decodeDelegationToken(encoded)
+		if err != nil {
+			return nil, err
+		}
+		return sasldigest.NewDigestMD5Client("", token.saslUsername(), token.saslPassword(), tokenSaslProtocol, tokenSaslServerName), nil
+	}
+	username, password, err := passwordCredentials("DIGEST-MD5", params)
+	if err != nil {
+		return nil, err
+	}
+	return sasldigest.NewDigestMD5Client("", username, password, "hive", host), nil
+}
+
+func newGssKerbClient(params map[string]string, host string) (sasl.Client, error) {
+	principal, ok := params["principal"]
+	if !ok {
+		return nil, errors.New("GSSAPI requires the principal parameter")
+	}
+	userPrincipal, ok := params["user.principal"]
+	if !ok {
+		return nil, errors.New("GSSAPI requires the user.principal parameter")
+	}
+	canonicalize := params["kerberosEnableCanonicalHostnameCheck"] != "false"
+	service, err := resolveServerPrincipal(principal, host, canonicalize)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := loadKerberosClient(userPrincipal, params["user.keytab"], params["user.krb5.conf"], service)
+	if err != nil {
+		return nil, err
+	}
+	if err := kc.ensureLogin(); err != nil {
+		return nil, err
+	}
+	spn := service.primary
+	if service.instance != "" {
+		spn += "/" + service.instance
+	}
+	kc.requestService(spn)
+	return saslgsskerb.NewGssKerbClient("", service.primary, service.instance, kc.client), nil
+}
@@ -0,0 +1,128 @@
+package hive2
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+// SaslServerFactory creates the server side of a SASL mechanism for one connection.
+type SaslServerFactory func() (sasl.Server, error)
+
+// TSaslServerTransport is the server side of TSaslClientTransport. It lets tests and
+// proxies authenticate Thrift clients the way HiveServer2 does.
+type TSaslServerTransport struct {
+	saslTransport
+	mechanisms map[string]SaslServerFactory
+	saslServer sasl.Server
+}
+
+func NewTSaslServerTransport(tp thrift.TTransport, mechanisms map[string]SaslServerFactory) *TSaslServerTransport {
+	t := &TSaslServerTransport{
+		saslTransport: newSaslTransport(tp, nil),
+		mechanisms:    mechanisms,
+	}
+	return t
+}
+
+// Open runs the server side of the negotiation: the client names a mechanism, then
+// responses and challenges are exchanged until the mechanism completes.
+func (t *TSaslServerTransport) Open() error {
+	if t.saslServer != nil {
+		return errors.New("SASL transport already open")
+	}
+	if !t.tp.IsOpen() {
+		if err := t.tp.Open(); err != nil {
+			return err
+		}
+	}
+	status, payload, err := t.receiveSaslMessage()
+	if err != nil {
+		return err
+	}
+	if status != START {
+		return t.negotiationFailed(ERROR, fmt.Errorf("expected START, got status %d", status))
+	}
+	factory, ok := t.mechanisms[string(payload)]
+	if !ok {
+		return t.negotiationFailed(BAD, fmt.Errorf("unsupported SASL mechanism %s", payload))
+	}
+	server, err := factory()
+	if err != nil {
+		return t.negotiationFailed(ERROR, err)
+	}
+	for !server.IsComplete() {
+		status, payload, err = t.receiveSaslMessage()
+		if err != nil {
+			return err
+		}
+		if status != OK && status != COMPLETE {
+			return t.negotiationFailed(ERROR, fmt.Errorf("expected COMPLETE or OK, got status %d", status))
+		}
+		challenge, err := server.EvaluateResponse(payload)
+		if err != nil {
+			return t.negotiationFailed(BAD, err)
+		}
+		status := OK
+		if server.IsComplete() {
+			status = COMPLETE
+		}
+		if _, err := t.sendSaslMessage(status, challenge); err != nil {
+			return err
+		}
+	}
+	t.saslServer = server
+	t.layer = server
+	return t.enableSecurityLayer(server.GetNegotiatedProperty)
+}
+
+func (t *TSaslServerTransport) IsOpen() bool {
+	return t.tp.IsOpen() && t.saslServer != nil
+}
+
+// AuthorizationID returns the identity the client authenticated as.
+func (t *TSaslServerTransport) AuthorizationID() string {
+	if t.saslServer == nil {
+		return ""
+	}
+	return t.saslServer.GetAuthorizationID()
+}
+
+var _ thrift.TTransport = (*TSaslServerTransport)(nil)
+
+// TSaslServerTransportFactory authenticates the connections accepted by a Thrift server.
+type TSaslServerTransportFactory struct {
+	mechanisms   map[string]SaslServerFactory
+	maxFrameSize int
+}
+
+func NewTSaslServerTransportFactory() *TSaslServerTransportFactory {
+	return &TSaslServerTransportFactory{
+		mechanisms:   map[string]SaslServerFactory{},
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetMaxFrameSize sets the largest negotiation message or frame accepted from clients.
+func (f *TSaslServerTransportFactory) SetMaxFrameSize(size int) {
+	f.maxFrameSize = size
+}
+
+// AddServerDefinition makes a mechanism available to clients.
+func (f *TSaslServerTransportFactory) AddServerDefinition(mechanism string, factory SaslServerFactory) {
+	f.mechanisms[mechanism] = factory
+}
+
+// GetTransport negotiates SASL on trans and returns the authenticated transport.
+func (f *TSaslServerTransportFactory) GetTransport(trans thrift.TTransport) (thrift.TTransport, error) {
+	t := NewTSaslServerTransport(trans, f.mechanisms)
+	t.SetMaxFrameSize(f.maxFrameSize)
+	if err := t.Open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var _ thrift.TTransportFactory = (*TSaslServerTransportFactory)(nil)
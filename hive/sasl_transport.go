@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"sync"
 
 	"github.com/apache/thrift/lib/go/thrift"
 	"github.com/mumuhhh/gohive2/sasl"
@@ -20,107 +22,212 @@ const (
 	COMPLETE byte = 5
 )
 
-type TSaslClientTransport struct {
-	tp         thrift.TTransport
-	saslClient sasl.Client
+// DefaultMaxFrameSize is the largest negotiation message or frame accepted from the peer
+// unless SetMaxFrameSize says otherwise.
+const DefaultMaxFrameSize = 104857600
+
+// frameBuffers recycles the buffers frames are assembled and unwrapped in; buffers grown
+// beyond maxPooledBuffer are left to the garbage collector.
+var frameBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+const maxPooledBuffer = 1 << 20
+
+func getFrameBuffer() *bytes.Buffer {
+	return frameBuffers.Get().(*bytes.Buffer)
+}
+
+func putFrameBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	frameBuffers.Put(buf)
+}
+
+// readPayload appends n bytes from r to buf. The buffer grows as data arrives, so a peer
+// announcing a large payload it never sends does not get it allocated.
+func readPayload(r io.Reader, buf *bytes.Buffer, n int) error {
+	if n <= 64*1024 {
+		buf.Grow(n)
+	}
+	copied, err := io.CopyN(buf, r, int64(n))
+	if copied < int64(n) && (err == nil || err == io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// securityLayer wraps and unwraps the frames of a SASL connection; both sasl.Client and
+// sasl.Server implement it.
+type securityLayer interface {
+	Wrap(outgoing []byte) ([]byte, error)
+	Unwrap(incoming []byte) ([]byte, error)
+}
+
+// saslTransport holds the framing shared by the client and the server transports.
+type saslTransport struct {
+	tp    thrift.TTransport
+	layer securityLayer
 
 	writeBuffer *bytes.Buffer
 	readBuffer  *bytes.Buffer
 	ctx         context.Context
+	readHeader  [5]byte
+	writeHeader [5]byte
 
 	shouldWrap bool
+	// rawSendSize is the most data wrapped into one frame, recvMaxBuffer the largest
+	// wrapped frame accepted from the peer; zero means no limit.
+	rawSendSize   int
+	recvMaxBuffer int
+	maxFrameSize  int
+	// frameRemaining is what is left to read of the current frame when it is not
+	// wrapped; such frames are read straight from the underlying transport.
+	frameRemaining int
 }
 
-func NewTSaslClientTransport(tp thrift.TTransport, saslClient sasl.Client) *TSaslClientTransport {
-	return &TSaslClientTransport{
-		tp:          tp,
-		saslClient:  saslClient,
-		ctx:         context.Background(),
-		writeBuffer: new(bytes.Buffer),
-		readBuffer:  new(bytes.Buffer),
+func newSaslTransport(tp thrift.TTransport, layer securityLayer) saslTransport {
+	return saslTransport{
+		tp:           tp,
+		layer:        layer,
+		ctx:          context.Background(),
+		writeBuffer:  new(bytes.Buffer),
+		readBuffer:   new(bytes.Buffer),
+		maxFrameSize: DefaultMaxFrameSize,
 	}
 }
 
-// ReadFrame reads a frame of data into local buffer, which means first read data's length, then reads actual data.
-func (t *TSaslClientTransport) ReadFrame() error {
-	header := make([]byte, 4)
-	var err error
-	if _, err := io.ReadFull(t.tp, header); err != nil {
+// SetMaxFrameSize sets the largest negotiation message or frame accepted from the peer,
+// DefaultMaxFrameSize by default.
+func (t *saslTransport) SetMaxFrameSize(size int) {
+	t.maxFrameSize = size
+}
+
+// checkFrameSize rejects frames and negotiation messages over the maximum frame size.
+func (t *saslTransport) checkFrameSize(length int) error {
+	if length > t.maxFrameSize {
+		return fmt.Errorf("SASL frame of %d bytes exceeds the maximum frame size of %d bytes", length, t.maxFrameSize)
+	}
+	return nil
+}
+
+// ReadFrame reads the header of the next frame. Wrapped frames are then read and
+// unwrapped into the local buffer; the data of other frames is left for Read.
+func (t *saslTransport) ReadFrame() error {
+	if _, err := io.ReadFull(t.tp, t.readHeader[:4]); err != nil {
 		return err
 	}
-	length := int(binary.BigEndian.Uint32(header))
-	data := make([]byte, length)
-	if _, err := io.ReadFull(t.tp, data); err != nil {
+	length := int(binary.BigEndian.Uint32(t.readHeader[:4]))
+	if err := t.checkFrameSize(length); err != nil {
 		return err
 	}
-	if t.shouldWrap {
-		data, err = t.saslClient.Unwrap(data)
-		if err != nil {
-			return err
-		}
+	if !t.shouldWrap {
+		t.frameRemaining = length
+		return nil
+	}
+	if t.recvMaxBuffer > 0 && length > t.recvMaxBuffer {
+		return fmt.Errorf("SASL frame of %d bytes exceeds the negotiated maximum of %d bytes", length, t.recvMaxBuffer)
+	}
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+	if err := readPayload(t.tp, buf, length); err != nil {
+		return err
+	}
+	data, err := t.layer.Unwrap(buf.Bytes())
+	if err != nil {
+		return err
 	}
 	_, err = t.readBuffer.Write(data)
 	return err
 }
 
-func (t *TSaslClientTransport) Read(p []byte) (n int, err error) {
-	n, err = t.readBuffer.Read(p)
-	if n > 0 {
-		return n, err
+func (t *saslTransport) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
-	if err := t.ReadFrame(); err != nil {
-		return 0, err
+	for t.readBuffer.Len() == 0 && t.frameRemaining == 0 {
+		if err := t.ReadFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if t.readBuffer.Len() > 0 {
+		return t.readBuffer.Read(p)
 	}
-	return t.readBuffer.Read(p)
+	if len(p) > t.frameRemaining {
+		p = p[:t.frameRemaining]
+	}
+	n, err = t.tp.Read(p)
+	t.frameRemaining -= n
+	if err == io.EOF && t.frameRemaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
-func (t *TSaslClientTransport) Write(p []byte) (n int, err error) {
+func (t *saslTransport) Write(p []byte) (n int, err error) {
 	return t.writeBuffer.Write(p)
 }
 
-func (t *TSaslClientTransport) Close() error {
+func (t *saslTransport) Close() error {
 	return t.tp.Close()
 }
 
-func (t *TSaslClientTransport) Flush(ctx context.Context) (err error) {
+// Flush sends the buffered data as one frame, or, with a security layer, as many frames
+// as it takes to keep each wrapped frame within the peer's maximum buffer size.
+func (t *saslTransport) Flush(ctx context.Context) (err error) {
 	buf := t.writeBuffer.Bytes()
-	dataLength := t.writeBuffer.Len()
-	if t.shouldWrap {
-		buf, err = t.saslClient.Wrap(buf)
-		if err != nil {
+	chunkSize := len(buf)
+	if t.shouldWrap && t.rawSendSize > 0 && t.rawSendSize < chunkSize {
+		chunkSize = t.rawSendSize
+	}
+	for {
+		n := chunkSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if err := t.writeFrame(buf[:n]); err != nil {
 			return err
 		}
-		dataLength = len(buf)
+		if buf = buf[n:]; len(buf) == 0 {
+			break
+		}
 	}
-	length := make([]byte, 4)
-	binary.BigEndian.PutUint32(length, uint32(dataLength))
+	t.writeBuffer.Reset()
+	return t.tp.Flush(ctx)
+}
 
-	frame := make([]byte, dataLength+4)
-	copy(frame, length[:4])
-	copy(frame[4:], buf[:dataLength])
-	_, err = t.tp.Write(frame)
-	if err == nil {
-		t.writeBuffer.Reset()
-		return t.tp.Flush(ctx)
+func (t *saslTransport) writeFrame(data []byte) (err error) {
+	if t.shouldWrap {
+		data, err = t.layer.Wrap(data)
+		if err != nil {
+			return err
+		}
 	}
+	frame := getFrameBuffer()
+	defer putFrameBuffer(frame)
+	binary.BigEndian.PutUint32(t.writeHeader[:4], uint32(len(data)))
+	frame.Write(t.writeHeader[:4])
+	frame.Write(data)
+	_, err = t.tp.Write(frame.Bytes())
 	return err
 }
 
-func (t *TSaslClientTransport) RemainingBytes() (numBytes uint64) {
-	return uint64(t.readBuffer.Len())
+func (t *saslTransport) RemainingBytes() (numBytes uint64) {
+	return uint64(t.readBuffer.Len() + t.frameRemaining)
 }
 
 // sendSaslMessage sends data length, status code and message body
-func (t *TSaslClientTransport) sendSaslMessage(status byte, body []byte) (int, error) {
-	data := make([]byte, len(body)+5)
-	header2 := make([]byte, 4)
-	binary.BigEndian.PutUint32(header2, uint32(len(body)))
-
-	data[0] = status
-	copy(data[1:], header2)
-	copy(data[5:], body)
+func (t *saslTransport) sendSaslMessage(status byte, body []byte) (int, error) {
+	message := getFrameBuffer()
+	defer putFrameBuffer(message)
+	t.writeHeader[0] = status
+	binary.BigEndian.PutUint32(t.writeHeader[1:], uint32(len(body)))
+	message.Write(t.writeHeader[:])
+	message.Write(body)
 
-	n, err := t.tp.Write(data)
+	n, err := t.tp.Write(message.Bytes())
 	if err != nil {
 		return n, err
 	}
@@ -130,28 +237,75 @@ func (t *TSaslClientTransport) sendSaslMessage(status byte, body []byte) (int, e
 	return n, nil
 }
 
-// receiveSaslMessage receives init response from server
-func (t *TSaslClientTransport) receiveSaslMessage() (byte, []byte, error) {
-	header := make([]byte, 5)
-	_, err := io.ReadFull(t.tp, header)
-	if err != nil {
+// receiveSaslMessage receives a negotiation message from the peer
+func (t *saslTransport) receiveSaslMessage() (byte, []byte, error) {
+	if _, err := io.ReadFull(t.tp, t.readHeader[:]); err != nil {
+		return 0, nil, err
+	}
+	status := t.readHeader[0]
+	payloadBytes := int(binary.BigEndian.Uint32(t.readHeader[1:]))
+	if err := t.checkFrameSize(payloadBytes); err != nil {
+		_, _ = t.sendSaslMessage(ERROR, []byte(err.Error()))
 		return 0, nil, err
 	}
+	var payload bytes.Buffer
+	if err := readPayload(t.tp, &payload, payloadBytes); err != nil {
+		return 0, nil, err
+	}
+	if status == BAD || status == ERROR {
+		return status, payload.Bytes(), fmt.Errorf("SASL negotiation failed: %s", payload.Bytes())
+	}
+	return status, payload.Bytes(), nil
+}
 
-	status := header[0]
-	payloadBytes := int(binary.BigEndian.Uint32(header[1:]))
-	var payload []byte
-	if payloadBytes < 0 && payloadBytes > 104857600 {
-		message := fmt.Sprintf("Invalid payload header length: %d", payloadBytes)
-		_, _ = t.sendSaslMessage(ERROR, []byte(message))
-		return 0, nil, errors.New(message)
-	} else {
-		payload = make([]byte, payloadBytes)
-		if _, err := io.ReadFull(t.tp, payload); err != nil {
-			return 0, nil, err
-		}
+// negotiationFailed reports err to the peer before returning it.
+func (t *saslTransport) negotiationFailed(status byte, err error) error {
+	_, _ = t.sendSaslMessage(status, []byte(err.Error()))
+	_ = t.tp.Close()
+	return err
+}
+
+// enableSecurityLayer turns on wrapping when the negotiated quality of protection is
+// integrity or privacy, along with the buffer size limits of the mechanism.
+func (t *saslTransport) enableSecurityLayer(getProperty func(string) (string, error)) error {
+	qop, err := getProperty("sasl.qop")
+	if err != nil {
+		return err
+	}
+	t.shouldWrap = qop == sasl.QopIntegrity || qop == sasl.QopPrivacy
+	if !t.shouldWrap {
+		return nil
+	}
+	if t.rawSendSize, err = sizeProperty(getProperty, "sasl.rawsendsize"); err != nil {
+		return err
+	}
+	t.recvMaxBuffer, err = sizeProperty(getProperty, "sasl.maxbuffer")
+	return err
+}
+
+// sizeProperty returns a buffer size property, zero if the mechanism does not report it.
+func sizeProperty(getProperty func(string) (string, error), name string) (int, error) {
+	value, err := getProperty(name)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return size, nil
+}
+
+type TSaslClientTransport struct {
+	saslTransport
+	saslClient sasl.Client
+}
+
+func NewTSaslClientTransport(tp thrift.TTransport, saslClient sasl.Client) *TSaslClientTransport {
+	return &TSaslClientTransport{
+		saslTransport: newSaslTransport(tp, saslClient),
+		saslClient:    saslClient,
 	}
-	return status, payload, nil
 }
 
 func (t *TSaslClientTransport) handleSaslStartMessage() error {
@@ -223,7 +377,9 @@ func (t *TSaslClientTransport) Open() (err error) {
 			return err
 		}
 	}
-	if msgStatus == OK {
+	// Unless the server already said so, wait for it to confirm the negotiation,
+	// including when the initial response was all the mechanism needed.
+	if msgStatus != COMPLETE {
 		msgStatus, _, err = t.receiveSaslMessage()
 		if err != nil {
 			return err
@@ -232,14 +388,7 @@ func (t *TSaslClientTransport) Open() (err error) {
 			return errors.New("expected SASL COMPLETE")
 		}
 	}
-	qop, err := t.saslClient.GetNegotiatedProperty("sasl.qop")
-	if err != nil {
-		return err
-	}
-	if qop != "auth" {
-		t.shouldWrap = true
-	}
-	return nil
+	return t.enableSecurityLayer(t.saslClient.GetNegotiatedProperty)
 }
 
 func (t *TSaslClientTransport) IsOpen() bool {
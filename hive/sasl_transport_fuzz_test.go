@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package hive2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+
+	sasldigest "github.com/mumuhhh/gohive2/sasl/digest"
+)
+
+var fuzzKey = []byte("0123456789abcdef")
+
+// fuzzLayer returns the security layer of a fuzzed frame: none, DIGEST-MD5 integrity or
+// DIGEST-MD5 privacy, with the same keys in both directions.
+func fuzzLayer(t *testing.T, kind byte) securityLayer {
+	switch kind % 3 {
+	case 1:
+		return sasldigest.NewDigestIntegrity(fuzzKey, fuzzKey)
+	case 2:
+		privacy, err := sasldigest.NewDigestPrivacy("3des", fuzzKey, fuzzKey, fuzzKey, fuzzKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return privacy
+	}
+	return nil
+}
+
+func fuzzTransport(t *testing.T, data []byte, kind byte) *saslTransport {
+	buffer := thrift.NewTMemoryBuffer()
+	buffer.Write(data)
+	transport := newSaslTransport(buffer, fuzzLayer(t, kind))
+	transport.shouldWrap = transport.layer != nil
+	transport.SetMaxFrameSize(4096)
+	return &transport
+}
+
+func FuzzSaslReadFrame(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 3, 'a', 'b', 'c'}, byte(0))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, 'x'}, byte(0))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, byte(0))
+	f.Add([]byte{0, 0, 0, 16, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, byte(1))
+	f.Add([]byte{0, 0, 0, 24, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24}, byte(2))
+	f.Fuzz(func(t *testing.T, data []byte, kind byte) {
+		transport := fuzzTransport(t, data, kind)
+		read, _ := io.Copy(io.Discard, transport)
+		if read > int64(len(data)) {
+			t.Fatalf("read %d bytes out of %d", read, len(data))
+		}
+	})
+}
+
+func FuzzSaslReceiveMessage(f *testing.F) {
+	f.Add([]byte{START, 0, 0, 0, 5, 'P', 'L', 'A', 'I', 'N'})
+	f.Add([]byte{OK, 0, 0, 0, 0, COMPLETE, 0, 0, 0, 1, 'x'})
+	f.Add([]byte{BAD, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		transport := fuzzTransport(t, data, 0)
+		for {
+			_, payload, err := transport.receiveSaslMessage()
+			if len(payload) > transport.maxFrameSize {
+				t.Fatalf("accepted a payload of %d bytes", len(payload))
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzSaslFrameRoundTrip(f *testing.F) {
+	f.Add([]byte("select 1"), uint16(0), byte(0))
+	f.Add(bytes.Repeat([]byte("select 1;"), 200), uint16(100), byte(1))
+	f.Add(bytes.Repeat([]byte("select 1;"), 200), uint16(7), byte(2))
+	f.Fuzz(func(t *testing.T, payload []byte, chunk uint16, kind byte) {
+		buffer := thrift.NewTMemoryBuffer()
+		writer := newSaslTransport(buffer, fuzzLayer(t, kind))
+		writer.shouldWrap = writer.layer != nil
+		writer.rawSendSize = int(chunk)
+		reader := newSaslTransport(buffer, fuzzLayer(t, kind))
+		reader.shouldWrap = reader.layer != nil
+
+		if _, err := writer.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		received := make([]byte, len(payload))
+		if _, err := io.ReadFull(&reader, received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal("payload corrupted")
+		}
+		// An empty flush still sends an empty frame.
+		if len(payload) > 0 && buffer.Len() != 0 {
+			t.Fatalf("%d bytes left unread", buffer.Len())
+		}
+	})
+}
@@ -0,0 +1,397 @@
+package hive2
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+
+	"github.com/mumuhhh/gohive2/sasl"
+	saslcrammd5 "github.com/mumuhhh/gohive2/sasl/crammd5"
+	sasldigest "github.com/mumuhhh/gohive2/sasl/digest"
+	saslplain "github.com/mumuhhh/gohive2/sasl/plain"
+)
+
+var testPasswords = map[string]string{"hive": "hive-secret"}
+
+func lookupTestPassword(username string) (string, error) {
+	if password, ok := testPasswords[username]; ok {
+		return password, nil
+	}
+	return "", errors.New("unknown user")
+}
+
+func verifyTestPassword(_, username, password string) error {
+	if expected, err := lookupTestPassword(username); err != nil || expected != password {
+		return errors.New("bad credentials")
+	}
+	return nil
+}
+
+func testServerMechanisms(qop ...string) map[string]SaslServerFactory {
+	return map[string]SaslServerFactory{
+		"PLAIN": func() (sasl.Server, error) {
+			return saslplain.NewPlainServer(verifyTestPassword), nil
+		},
+		"CRAM-MD5": func() (sasl.Server, error) {
+			return saslcrammd5.NewCramMD5Server("hs2.example.com", lookupTestPassword), nil
+		},
+		"DIGEST-MD5": func() (sasl.Server, error) {
+			server := sasldigest.NewDigestMD5Server("hive", "hs2.example.com", "HADOOP.COM", lookupTestPassword)
+			server.SetAllowedQop(qop)
+			return server, nil
+		},
+	}
+}
+
+// saslPair negotiates client against a server transport over a loopback connection.
+func saslPair(t *testing.T, client sasl.Client, mechanisms map[string]SaslServerFactory) (*TSaslClientTransport, *TSaslServerTransport, error, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	serverTransport := NewTSaslServerTransport(thrift.NewTSocketFromConnConf(serverConn, &thrift.TConfiguration{}), mechanisms)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- serverTransport.Open()
+	}()
+	clientTransport := NewTSaslClientTransport(thrift.NewTSocketFromConnConf(clientConn, &thrift.TConfiguration{}), client)
+	clientErr := clientTransport.Open()
+	if clientErr != nil {
+		clientConn.Close()
+	}
+	return clientTransport, serverTransport, clientErr, <-serverErr
+}
+
+// exchange sends payload in both directions and checks it arrives intact.
+func exchange(t *testing.T, client, server thrift.TTransport, payload []byte) {
+	t.Helper()
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		received := make([]byte, len(payload))
+		if _, err := io.ReadFull(server, received); err != nil {
+			done <- err
+			return
+		}
+		if !bytes.Equal(received, payload) {
+			done <- errors.New("server received corrupted payload")
+			return
+		}
+		if _, err := server.Write(received); err != nil {
+			done <- err
+			return
+		}
+		done <- server.Flush(ctx)
+	}()
+	if _, err := client.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Fatal("client received corrupted payload")
+	}
+}
+
+func TestSaslHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		client sasl.Client
+		qop    string
+	}{
+		{"PLAIN", saslplain.NewPlainClient("", "hive", "hive-secret"), sasl.QopAuthentication},
+		{"CRAM-MD5", saslcrammd5.NewCramMD5Client("hive", "hive-secret"), sasl.QopAuthentication},
+		{"DIGEST-MD5 auth", sasldigest.NewDigestMD5Client("", "hive", "hive-secret", "hive", "hs2.example.com"), sasl.QopAuthentication},
+		{"DIGEST-MD5 auth-int", sasldigest.NewDigestMD5Client("", "hive", "hive-secret", "hive", "hs2.example.com"), sasl.QopIntegrity},
+		{"DIGEST-MD5 auth-conf", sasldigest.NewDigestMD5Client("", "hive", "hive-secret", "hive", "hs2.example.com"), sasl.QopPrivacy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, clientErr, serverErr := saslPair(t, tt.client, testServerMechanisms(tt.qop))
+			if clientErr != nil || serverErr != nil {
+				t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+			}
+			if got := server.AuthorizationID(); got != "hive" {
+				t.Errorf("AuthorizationID = %q", got)
+			}
+			if qop, _ := tt.client.GetNegotiatedProperty("sasl.qop"); qop != tt.qop {
+				t.Errorf("qop = %q, want %q", qop, tt.qop)
+			}
+			if client.shouldWrap != (tt.qop != sasl.QopAuthentication) || server.shouldWrap != client.shouldWrap {
+				t.Errorf("shouldWrap client = %v, server = %v", client.shouldWrap, server.shouldWrap)
+			}
+			for i := 0; i < 3; i++ {
+				exchange(t, client, server, bytes.Repeat([]byte("select 1;"), 100+i))
+			}
+		})
+	}
+}
+
+func TestSaslHandshakeFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		client sasl.Client
+	}{
+		{"PLAIN", saslplain.NewPlainClient("", "hive", "wrong")},
+		{"CRAM-MD5", saslcrammd5.NewCramMD5Client("hive", "wrong")},
+		{"DIGEST-MD5", sasldigest.NewDigestMD5Client("", "hive", "wrong", "hive", "hs2.example.com")},
+		{"unknown mechanism", saslplain.NewPlainClient("", "nobody", "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mechanisms := testServerMechanisms()
+			if tt.name == "unknown mechanism" {
+				delete(mechanisms, "PLAIN")
+			}
+			_, _, clientErr, serverErr := saslPair(t, tt.client, mechanisms)
+			if clientErr == nil || serverErr == nil {
+				t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+			}
+			if !strings.Contains(clientErr.Error(), "SASL negotiation failed") {
+				t.Errorf("client error = %v", clientErr)
+			}
+		})
+	}
+}
+
+func TestConnectOverSasl(t *testing.T) {
+	factory := NewTSaslServerTransportFactory()
+	for name, mechanism := range testServerMechanisms() {
+		factory.AddServerDefinition(name, mechanism)
+	}
+	server := startFakeServerWithTransport(t, newFakeHive(), factory)
+	// The client uses the address it dials as the digest-uri host.
+	host, _, _ := net.SplitHostPort(server.addr())
+	factory.AddServerDefinition("DIGEST-MD5", func() (sasl.Server, error) {
+		server := sasldigest.NewDigestMD5Server("hive", host, "HADOOP.COM", lookupTestPassword)
+		server.SetAllowedQop([]string{sasl.QopPrivacy})
+		return server, nil
+	})
+
+	for _, mechanism := range []string{"PLAIN", "CRAM-MD5", "DIGEST-MD5"} {
+		params, err := ParseUrl("hive2://" + server.addr() + "/default;username=hive;password=hive-secret;saslMechanism=" + mechanism)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := NewConnector(params).Connect(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", mechanism, err)
+		}
+		conn.Close()
+	}
+
+	// DIGEST-MD5 negotiates auth-conf, while PLAIN cannot go beyond auth.
+	params, _ := ParseUrl("hive2://" + server.addr() + "/default;username=hive;password=hive-secret;saslMechanism=DIGEST-MD5")
+	if conn, err := NewConnector(params, WithSaslQop(sasl.QopPrivacy)).Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+	params, _ = ParseUrl("hive2://" + server.addr() + "/default;username=hive;password=hive-secret;saslMechanism=PLAIN;saslQop=auth-conf")
+	if _, err := NewConnector(params).Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "saslQop") {
+		t.Errorf("expected saslQop violation, got %v", err)
+	}
+}
+
+func TestConnectWithDelegationToken(t *testing.T) {
+	identifier, password := []byte("owner=etl,renewer=oozie"), []byte{1, 2, 3, 4, 5}
+	token := encodeTestToken(identifier, password, "HIVE_DELEGATION_TOKEN", "")
+	factory := NewTSaslServerTransportFactory()
+	factory.AddServerDefinition("DIGEST-MD5", func() (sasl.Server, error) {
+		return sasldigest.NewDigestMD5Server(tokenSaslProtocol, tokenSaslServerName, "default", func(username string) (string, error) {
+			if username != "b3duZXI9ZXRsLHJlbmV3ZXI9b296aWU=" {
+				return "", errors.New("unknown token")
+			}
+			return "AQIDBAU=", nil
+		}), nil
+	})
+	server := startFakeServerWithTransport(t, newFakeHive(), factory)
+
+	params, err := ParseUrl("hive2://" + server.addr() + "/default;auth=delegationToken;delegationToken=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewConnector(params).Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestSaslMaxBuffer(t *testing.T) {
+	for _, qop := range []string{sasl.QopIntegrity, sasl.QopPrivacy} {
+		t.Run(qop, func(t *testing.T) {
+			client := sasldigest.NewDigestMD5Client("", "hive", "hive-secret", "hive", "hs2.example.com")
+			client.SetMaxBuffer(2048)
+			mechanisms := map[string]SaslServerFactory{
+				"DIGEST-MD5": func() (sasl.Server, error) {
+					server := sasldigest.NewDigestMD5Server("hive", "hs2.example.com", "HADOOP.COM", lookupTestPassword)
+					server.SetAllowedQop([]string{qop})
+					server.SetMaxBuffer(1024)
+					return server, nil
+				},
+			}
+			clientTransport, serverTransport, clientErr, serverErr := saslPair(t, client, mechanisms)
+			if clientErr != nil || serverErr != nil {
+				t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+			}
+			if clientTransport.recvMaxBuffer != 2048 || serverTransport.recvMaxBuffer != 1024 {
+				t.Errorf("recvMaxBuffer client = %d, server = %d", clientTransport.recvMaxBuffer, serverTransport.recvMaxBuffer)
+			}
+			if clientTransport.rawSendSize <= 0 || clientTransport.rawSendSize > 1024 {
+				t.Errorf("client rawSendSize = %d", clientTransport.rawSendSize)
+			}
+			// Either side rejects frames over its limit, so the exchange only succeeds when
+			// both split their writes.
+			exchange(t, clientTransport, serverTransport, bytes.Repeat([]byte("0123456789"), 10000))
+
+			clientTransport.rawSendSize = 0
+			if _, err := clientTransport.Write(make([]byte, 8192)); err != nil {
+				t.Fatal(err)
+			}
+			if err := clientTransport.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			_, err := serverTransport.Read(make([]byte, 1))
+			if err == nil || !strings.Contains(err.Error(), "exceeds the negotiated maximum") {
+				t.Errorf("expected an oversized frame error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectOverSaslLargeStatements(t *testing.T) {
+	for _, qop := range []string{sasl.QopIntegrity, sasl.QopPrivacy} {
+		t.Run(qop, func(t *testing.T) {
+			hive := newFakeHive()
+			factory := NewTSaslServerTransportFactory()
+			server := startFakeServerWithTransport(t, hive, factory)
+			host, _, _ := net.SplitHostPort(server.addr())
+			factory.AddServerDefinition("DIGEST-MD5", func() (sasl.Server, error) {
+				server := sasldigest.NewDigestMD5Server("hive", host, "HADOOP.COM", lookupTestPassword)
+				server.SetAllowedQop([]string{qop})
+				return server, nil
+			})
+
+			large := strings.Repeat("x", 300*1024)
+			statement := "insert into t values ('" + large + "')"
+			hive.setResult("select v from t", &fakeResult{columns: []string{"v"}, rows: [][]string{{large}}})
+
+			params, err := ParseUrl("hive2://" + server.addr() + "/default;username=hive;password=hive-secret;saslMechanism=DIGEST-MD5;saslQop=" + qop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db := sql.OpenDB(NewConnector(params))
+			defer db.Close()
+			if _, err := db.Exec(statement); err != nil {
+				t.Fatal(err)
+			}
+			if executed := hive.executed(); len(executed) != 1 || executed[0] != statement {
+				t.Fatalf("server did not receive the statement intact")
+			}
+			var v string
+			if err := db.QueryRow("select v from t").Scan(&v); err != nil {
+				t.Fatal(err)
+			}
+			if v != large {
+				t.Errorf("received a value of %d bytes, want %d", len(v), len(large))
+			}
+		})
+	}
+}
+
+func TestSaslMaxBufferParam(t *testing.T) {
+	for _, value := range []string{"0", "16777216", "big"} {
+		params, _ := ParseUrl("hive2://127.0.0.1:1/default;username=hive;password=hive-secret;saslMechanism=DIGEST-MD5;saslMaxBuffer=" + value)
+		if _, err := NewConnector(params).Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "saslMaxBuffer") {
+			t.Errorf("saslMaxBuffer=%s: expected an error, got %v", value, err)
+		}
+	}
+}
+
+func TestSaslMaxFrameSize(t *testing.T) {
+	// The server rejects a negotiation message over its limit and tells the client.
+	mechanisms := testServerMechanisms()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		server := NewTSaslServerTransport(thrift.NewTSocketFromConnConf(conn, &thrift.TConfiguration{}), mechanisms)
+		server.SetMaxFrameSize(4)
+		serverErr <- server.Open()
+	}()
+	socket := thrift.NewTSocketFromAddrConf(listener.Addr(), &thrift.TConfiguration{})
+	client := NewTSaslClientTransport(socket, saslplain.NewPlainClient("", "hive", "hive-secret"))
+	if err := client.Open(); err == nil || !strings.Contains(err.Error(), "maximum frame size") {
+		t.Errorf("client: expected the server's frame size error, got %v", err)
+	}
+	if err := <-serverErr; err == nil || !strings.Contains(err.Error(), "maximum frame size") {
+		t.Errorf("server: expected a frame size error, got %v", err)
+	}
+
+	// Without a security layer, the limit applies to data frames.
+	clientTransport, serverTransport, clientErr, serverErr2 := saslPair(t, saslplain.NewPlainClient("", "hive", "hive-secret"), testServerMechanisms())
+	if clientErr != nil || serverErr2 != nil {
+		t.Fatalf("client: %v, server: %v", clientErr, serverErr2)
+	}
+	serverTransport.SetMaxFrameSize(1024)
+	exchange(t, clientTransport, serverTransport, make([]byte, 1024))
+	if _, err := clientTransport.Write(make([]byte, 1025)); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientTransport.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverTransport.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "maximum frame size") {
+		t.Errorf("expected a frame size error, got %v", err)
+	}
+}
+
+func TestReadPayloadAllocation(t *testing.T) {
+	var buf bytes.Buffer
+	err := readPayload(strings.NewReader("short"), &buf, DefaultMaxFrameSize)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if buf.Cap() > 64*1024 {
+		t.Errorf("allocated %d bytes for a 5 byte payload", buf.Cap())
+	}
+}
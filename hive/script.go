@@ -0,0 +1,223 @@
+package hive2
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// ScriptStatement is a statement of a HiveQL script.
+type ScriptStatement struct {
+	// Text is the statement without its terminating semicolon and its comments, except
+	// optimizer hints such as /*+ MAPJOIN(b) */.
+	Text string
+	// Line is the line of the script the statement starts on, from 1.
+	Line int
+	// Command is set for beeline commands such as !set or !connect, which take the rest
+	// of their line and need no semicolon.
+	Command bool
+}
+
+// SplitStatements splits a HiveQL script into its statements, separated by semicolons
+// outside of quotes, backticks and comments. Empty statements are left out.
+func SplitStatements(r io.Reader) ([]ScriptStatement, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	script := string(data)
+
+	var statements []ScriptStatement
+	var text strings.Builder
+	line, start := 1, 0
+	flush := func(command bool) {
+		if s := strings.TrimSpace(text.String()); s != "" {
+			statements = append(statements, ScriptStatement{Text: s, Line: start, Command: command})
+		}
+		text.Reset()
+	}
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		comment := strings.HasPrefix(script[i:], "--") ||
+			strings.HasPrefix(script[i:], "/*") && !strings.HasPrefix(script[i:], "/*+")
+		if start == 0 && !comment && c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			start = line
+		}
+		switch {
+		case c == '\n':
+			line++
+			text.WriteByte(c)
+		case c == '!' && strings.TrimSpace(text.String()) == "":
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			text.WriteString(script[i : i+end])
+			flush(true)
+			start = 0
+			i += end - 1
+		case c == '\'' || c == '"' || c == '`':
+			end := closingQuote(script, i)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated %c", line, c)
+			}
+			text.WriteString(script[i : end+1])
+			line += strings.Count(script[i:end+1], "\n")
+			i = end
+		case strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			i += end - 1
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			block := script[i : i+2+end+2]
+			if strings.HasPrefix(block, "/*+") {
+				text.WriteString(block)
+			} else {
+				text.WriteByte(' ')
+			}
+			line += strings.Count(block, "\n")
+			i += len(block) - 1
+		case c == ';':
+			flush(false)
+			start = 0
+		default:
+			text.WriteByte(c)
+		}
+	}
+	flush(false)
+	return statements, nil
+}
+
+// closingQuote returns the index of the quote closing the one at script[open], -1 if there
+// is none. Backslashes escape characters in strings but not in backticks, where a quoted
+// backtick is doubled.
+func closingQuote(script string, open int) int {
+	quote := script[open]
+	for i := open + 1; i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// ScriptResult is the outcome of a statement run by ExecScript.
+type ScriptResult struct {
+	Statement ScriptStatement
+	// RowsAffected is the number of rows the statement modified, -1 when unknown.
+	RowsAffected int64
+	// Err is the error of the statement.
+	Err error
+	// Skipped is set for beeline commands, which the driver does not run.
+	Skipped bool
+}
+
+// ScriptError is the error of a statement run by ExecScript.
+type ScriptError struct {
+	Statement ScriptStatement
+	Err       error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Statement.Line, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// ScriptOption configures ExecScript.
+type ScriptOption func(*scriptOptions)
+
+type scriptOptions struct {
+	continueOnError bool
+}
+
+// ScriptContinueOnError makes ExecScript run the statements after one that failed.
+func ScriptContinueOnError() ScriptOption {
+	return func(o *scriptOptions) {
+		o.continueOnError = true
+	}
+}
+
+type substitutedKey struct{}
+
+// ExecScript runs the statements of a HiveQL script one after the other on conn, with the
+// settings of WithConf in ctx. Variables such as ${hivevar:name} are substituted as
+// Variables does, with the variables of the connection and those set by earlier SET
+// hivevar:name=value or SET hiveconf:key=value statements of the script; unknown
+// variables are left for the server to substitute unless the connection's
+// undefinedVariables policy says otherwise.
+//
+// ExecScript stops at the first statement that fails, unless ScriptContinueOnError is
+// given, and returns the results of the statements it ran along with the *ScriptError of
+// the first failure.
+func ExecScript(ctx context.Context, conn *sql.Conn, r io.Reader, opts ...ScriptOption) ([]ScriptResult, error) {
+	var o scriptOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	statements, err := SplitStatements(r)
+	if err != nil {
+		return nil, err
+	}
+	var vars *Variables
+	err = withHiveConn(conn, func(hc *hiveConn) error {
+		vars = hc.vars.clone()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The statements are substituted here already; doing it again would undo escapes.
+	ctx = context.WithValue(ctx, substitutedKey{}, true)
+	var results []ScriptResult
+	var firstErr error
+	for _, statement := range statements {
+		result := ScriptResult{Statement: statement, RowsAffected: -1}
+		if statement.Command {
+			result.Skipped = true
+			results = append(results, result)
+			continue
+		}
+		text, err := vars.Substitute(statement.Text)
+		var res sql.Result
+		if err == nil {
+			statement.Text = text
+			result.Statement = statement
+			res, err = conn.ExecContext(ctx, statement.Text)
+		}
+		if err == nil {
+			if n, err := res.RowsAffected(); err == nil {
+				result.RowsAffected = n
+			}
+			vars.trackSet(statement.Text)
+		}
+		result.Err = err
+		results = append(results, result)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = &ScriptError{Statement: statement, Err: err}
+			}
+			if !o.continueOnError {
+				break
+			}
+		}
+	}
+	return results, firstErr
+}
@@ -0,0 +1,135 @@
+package hive2
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- nightly load
+SET hive.exec.dynamic.partition.mode=nonstrict;
+!set showHeader false
+/* a comment; with a semicolon */
+insert into t select ';', "a \" ; b", ` + "`odd;col`" + ` from s; -- trailing
+select /*+ MAPJOIN(b) */ a
+  -- inner comment; still the select
+  from a join b on a.k = b.k
+;;
+select 'multi
+line'
+`
+	statements, err := SplitStatements(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScriptStatement{
+		{Text: "SET hive.exec.dynamic.partition.mode=nonstrict", Line: 2},
+		{Text: "!set showHeader false", Line: 3, Command: true},
+		{Text: `insert into t select ';', "a \" ; b", ` + "`odd;col`" + ` from s`, Line: 5},
+		{Text: "select /*+ MAPJOIN(b) */ a\n  \n  from a join b on a.k = b.k", Line: 6},
+		{Text: "select 'multi\nline'", Line: 10},
+	}
+	if !reflect.DeepEqual(statements, want) {
+		t.Errorf("statements\n%+v, want\n%+v", statements, want)
+	}
+
+	for _, script := range []string{"select 'open", "select `open", "select 1 /* open"} {
+		if _, err := SplitStatements(strings.NewReader(script)); err == nil {
+			t.Errorf("%q: expected an error", script)
+		}
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	hive := newFakeHive()
+	hive.protocol = tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11
+	hive.setResult("insert into t partition (day='2024-01-01') select * from s", &fakeResult{modified: 7})
+	db := openFakeDB(t, startFakeServer(t, hive), "#day=2024-01-01;table=t")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	script := `!connect jdbc:hive2://localhost:10000
+set hivevar:source=s;
+insert into ${hivevar:table} partition (day='${hivevar:day}') select * from ${hivevar:source};
+select ${hivevar:unknown};`
+	results, err := ExecScript(ctx, conn, strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || !results[0].Skipped || results[2].RowsAffected != 7 {
+		t.Errorf("results %+v", results)
+	}
+	want := []string{
+		// The value to restore when the connection goes back to the pool.
+		"set hivevar:source",
+		"set hivevar:source=s",
+		"insert into t partition (day='2024-01-01') select * from s",
+		"select ${hivevar:unknown}",
+	}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+}
+
+func TestExecScriptSubstitutesOnce(t *testing.T) {
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), ";substituteVariables=true#x=1")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := ExecScript(ctx, conn, strings.NewReader(`select '\${x}', ${x};`)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"select '${x}', 1"}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+}
+
+func TestExecScriptErrors(t *testing.T) {
+	script := "select 1;\ncreate table t (a int);\nselect 2;"
+	for _, tt := range []struct {
+		name     string
+		opts     []ScriptOption
+		executed int
+	}{
+		{"stop", nil, 2},
+		{"continue", []ScriptOption{ScriptContinueOnError()}, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hive := newFakeHive()
+			hive.setResult("create table t (a int)", &fakeResult{failure: "Table t already exists"})
+			db := openFakeDB(t, startFakeServer(t, hive), "")
+			ctx := context.Background()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			results, err := ExecScript(ctx, conn, strings.NewReader(script), tt.opts...)
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) || scriptErr.Statement.Line != 2 {
+				t.Fatalf("expected an error on line 2, got %v", err)
+			}
+			if len(results) != tt.executed || results[1].Err == nil {
+				t.Errorf("results %+v", results)
+			}
+			if executed := hive.executed(); len(executed) != tt.executed {
+				t.Errorf("executed %q", executed)
+			}
+		})
+	}
+}
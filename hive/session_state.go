@@ -0,0 +1,287 @@
+package hive2
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// SessionReset is what happens to a pooled connection whose session state was changed by
+// SET, USE, RESET, ADD JAR or CREATE TEMPORARY FUNCTION statements, before database/sql
+// hands it to its next user.
+type SessionReset string
+
+const (
+	// SessionResetRestore sets the database and the changed HiveConf and HiveVar back
+	// to the values of the connection parameters, or to the values they had before the
+	// first SET for settings the parameters do not give. Connections with changes that
+	// cannot be undone, such as added jars or settings that were undefined, are
+	// discarded.
+	SessionResetRestore SessionReset = "restore"
+	// SessionResetDiscard discards every connection whose session state was changed.
+	SessionResetDiscard SessionReset = "discard"
+	// SessionResetNone reuses connections as they are.
+	SessionResetNone SessionReset = "none"
+)
+
+// WithSessionReset selects what happens to connections whose session state was changed;
+// it overrides the sessionReset connection parameter, which defaults to restore.
+func WithSessionReset(reset SessionReset) ConnectorOption {
+	return func(c *connector) {
+		c.reset = reset
+	}
+}
+
+func (c *connector) sessionResetPolicy() (SessionReset, error) {
+	reset := c.reset
+	if reset == "" {
+		reset = SessionReset(c.params.SessionVar["sessionReset"])
+	}
+	switch reset {
+	case "":
+		return SessionResetRestore, nil
+	case SessionResetRestore, SessionResetDiscard, SessionResetNone:
+		return reset, nil
+	}
+	return "", fmt.Errorf("invalid sessionReset %q: must be restore, discard or none", reset)
+}
+
+// sessionState records how statements changed the session since it was opened or reset.
+type sessionState struct {
+	database bool
+	// conf holds the names given to SET, such as hive.exec.parallel or hivevar:day.
+	conf map[string]bool
+	// prior holds the values settings the connection parameters do not give had before
+	// the first SET changing them.
+	prior map[string]string
+	// reset is set by RESET, which reverts every setting to the server's default.
+	reset bool
+	// permanent is set by changes that cannot be undone.
+	permanent bool
+}
+
+func (s *sessionState) changed() bool {
+	return s.database || len(s.conf) > 0 || s.reset || s.permanent
+}
+
+// trackStatement records the changes sql makes to the session.
+func (hc *hiveConn) trackStatement(sql string) {
+	sql = skipLeadingComments(sql)
+	words := strings.Fields(strings.ToLower(sql))
+	if len(words) == 0 {
+		return
+	}
+	state := &hc.session
+	switch words[0] {
+	case "use":
+		state.database = true
+	case "reset":
+		state.reset = true
+	case "add":
+		// ADD JAR, FILE or ARCHIVE.
+		state.permanent = true
+	case "create":
+		if len(words) > 2 && words[1] == "temporary" && (words[2] == "function" || words[2] == "macro") {
+			state.permanent = true
+		}
+	case "set":
+		name, ok := setName(sql)
+		if !ok {
+			// SET and SET -v list settings, SET ROLE changes the role of the session.
+			if len(words) > 1 && words[1] == "role" {
+				state.permanent = true
+			}
+			return
+		}
+		if state.conf == nil {
+			state.conf = map[string]bool{}
+		}
+		state.conf[name] = true
+	}
+}
+
+// setName returns the name a SET name=value statement sets.
+func setName(sql string) (string, bool) {
+	sql = skipLeadingComments(sql)
+	fields := strings.Fields(sql)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "set") {
+		return "", false
+	}
+	setting := strings.TrimSpace(sql[len("set"):])
+	eq := strings.Index(setting, "=")
+	if eq < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(setting[:eq]), true
+}
+
+// paramValue returns the value the connection parameters give the setting name.
+func (hc *hiveConn) paramValue(name string) (string, bool) {
+	switch {
+	case strings.HasPrefix(name, "hivevar:"):
+		value, ok := hc.params.HiveVar[strings.TrimPrefix(name, "hivevar:")]
+		return value, ok
+	case strings.HasPrefix(name, "system:"), strings.HasPrefix(name, "env:"):
+		return "", false
+	}
+	value, ok := hc.params.HiveConf[strings.TrimPrefix(name, "hiveconf:")]
+	return value, ok
+}
+
+// savePriorValue records the value of the setting sql changes, when it is the first
+// change to a setting the connection parameters do not give, so that restoreSession can
+// set it back. The value is asked with SET name; without an answer the connection is
+// discarded instead.
+func (hc *hiveConn) savePriorValue(ctx context.Context, sql string) {
+	name, ok := setName(sql)
+	if !ok || hc.sessionReset != SessionResetRestore || hc.session.conf[name] {
+		return
+	}
+	if _, ok := hc.paramValue(name); ok || strings.HasPrefix(name, "system:") || strings.HasPrefix(name, "env:") {
+		return
+	}
+	value, ok, err := hc.settingValue(ctx, name)
+	if err != nil || !ok {
+		return
+	}
+	if hc.session.prior == nil {
+		hc.session.prior = map[string]string{}
+	}
+	hc.session.prior[name] = value
+}
+
+// settingValue returns the value SET name shows, and false when the setting is undefined.
+func (hc *hiveConn) settingValue(ctx context.Context, name string) (string, bool, error) {
+	stmt := &hiveStmt{hc: hc, sql: "set " + name, untracked: true}
+	defer stmt.Close()
+	rows, err := stmt.query(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	if len(rows.Columns()) == 0 {
+		return "", false, nil
+	}
+	dest := make([]driver.Value, len(rows.Columns()))
+	if err := rows.Next(dest); err != nil {
+		if err == io.EOF {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	// Hive answers name=value, or "name is undefined".
+	line, _ := dest[0].(string)
+	if !strings.HasPrefix(line, name+"=") {
+		return "", false, nil
+	}
+	return line[len(name)+1:], true, nil
+}
+
+// skipLeadingComments returns sql without the white space and comments before the
+// statement.
+func skipLeadingComments(sql string) string {
+	for {
+		sql = strings.TrimSpace(sql)
+		switch {
+		case strings.HasPrefix(sql, "--"):
+			end := strings.Index(sql, "\n")
+			if end < 0 {
+				return ""
+			}
+			sql = sql[end+1:]
+		case strings.HasPrefix(sql, "/*"):
+			end := strings.Index(sql, "*/")
+			if end < 0 {
+				return ""
+			}
+			sql = sql[end+2:]
+		default:
+			return sql
+		}
+	}
+}
+
+// restoreStatements returns the statements setting the session back to the connection
+// parameters and the values saved by savePriorValue, and false if some change cannot be
+// undone.
+func (hc *hiveConn) restoreStatements() ([]string, bool) {
+	state := hc.session
+	if state.permanent {
+		return nil, false
+	}
+	conf := map[string]bool{}
+	for name := range state.conf {
+		conf[name] = true
+	}
+	if state.reset {
+		for name := range hc.params.HiveConf {
+			conf[name] = true
+		}
+	}
+	names := make([]string, 0, len(conf))
+	for name := range conf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var statements []string
+	for _, name := range names {
+		value, ok := hc.paramValue(name)
+		if !ok {
+			value, ok = state.prior[name]
+		}
+		if !ok {
+			// Hive cannot unset a setting the session did not start with.
+			return nil, false
+		}
+		statements = append(statements, "set "+name+"="+value)
+	}
+	if state.database {
+		database := hc.params.DBName
+		if database == "" {
+			database = "default"
+		}
+		statements = append(statements, "use `"+strings.Replace(database, "`", "``", -1)+"`")
+	}
+	return statements, true
+}
+
+// restoreSession runs the statements of restoreStatements; the connection is bad when
+// they fail.
+func (hc *hiveConn) restoreSession(ctx context.Context) error {
+	statements, ok := hc.restoreStatements()
+	if !ok {
+		hc.bad = true
+		return driver.ErrBadConn
+	}
+	for _, sql := range statements {
+		stmt := &hiveStmt{hc: hc, sql: sql, untracked: true}
+		_, err := stmt.exec(ctx)
+		if closeErr := stmt.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			hc.bad = true
+			return driver.ErrBadConn
+		}
+	}
+	hc.session = sessionState{}
+	return nil
+}
+
+// reusable reports whether the connection may go back to the pool with its session state.
+func (hc *hiveConn) reusable() bool {
+	if !hc.session.changed() {
+		return true
+	}
+	switch hc.sessionReset {
+	case SessionResetDiscard:
+		return false
+	case SessionResetRestore:
+		_, ok := hc.restoreStatements()
+		return ok
+	}
+	return true
+}
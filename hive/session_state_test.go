@@ -0,0 +1,174 @@
+package hive2
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrackStatement(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want sessionState
+	}{
+		{"select 1", sessionState{}},
+		{"set", sessionState{}},
+		{"SET -v", sessionState{}},
+		{"set mapreduce.job.queuename = etl", sessionState{conf: map[string]bool{"mapreduce.job.queuename": true}}},
+		{"-- switch queues\n  /* for the report */ SET hivevar:day=1", sessionState{conf: map[string]bool{"hivevar:day": true}}},
+		{"USE sales", sessionState{database: true}},
+		{"reset", sessionState{reset: true}},
+		{"set role admin", sessionState{permanent: true}},
+		{"ADD JAR hdfs:///udf.jar", sessionState{permanent: true}},
+		{"create temporary function f as 'com.example.F'", sessionState{permanent: true}},
+		{"create function f as 'com.example.F'", sessionState{}},
+	}
+	for _, tt := range tests {
+		hc := &hiveConn{}
+		hc.trackStatement(tt.sql)
+		if !reflect.DeepEqual(hc.session, tt.want) {
+			t.Errorf("%q: %+v, want %+v", tt.sql, hc.session, tt.want)
+		}
+	}
+}
+
+func openResetDB(t *testing.T, s *fakeServer, params string, opts ...ConnectorOption) *sql.DB {
+	t.Helper()
+	p, err := ParseUrl("hive2://" + s.addr() + "/sales;auth=noSasl" + params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(NewConnector(p, opts...))
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSessionResetRestore(t *testing.T) {
+	hive := newFakeHive()
+	db := openResetDB(t, startFakeServer(t, hive), "?hive.exec.parallel=true#day=1")
+	for _, sql := range []string{"set hive.exec.parallel=false", "use other", "set hivevar:day=2", "select 1"} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"set hive.exec.parallel=false", "set hive.exec.parallel=true",
+		"use other", "use `sales`",
+		"set hivevar:day=2", "set hivevar:day=1",
+		"select 1",
+	}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed\n%q, want\n%q", executed, want)
+	}
+	if opened := hive.opened(); opened != 1 {
+		t.Errorf("opened %d sessions, want 1", opened)
+	}
+}
+
+func TestSessionResetRestorePriorValue(t *testing.T) {
+	hive := newFakeHive()
+	hive.setResult("set mapreduce.job.queuename", &fakeResult{columns: []string{"set"}, rows: [][]string{{"mapreduce.job.queuename=default"}}})
+	db := openResetDB(t, startFakeServer(t, hive), "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{"set mapreduce.job.queuename=etl", "set mapreduce.job.queuename=adhoc"} {
+		if _, err := conn.ExecContext(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	if _, err := db.Exec("select 1"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first SET asks for the value to restore.
+	want := []string{
+		"set mapreduce.job.queuename", "set mapreduce.job.queuename=etl",
+		"set mapreduce.job.queuename=adhoc",
+		"set mapreduce.job.queuename=default",
+		"select 1",
+	}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed\n%q, want\n%q", executed, want)
+	}
+	if opened := hive.opened(); opened != 1 {
+		t.Errorf("opened %d sessions, want 1", opened)
+	}
+}
+
+func TestSessionResetCancelled(t *testing.T) {
+	server := startFakeServer(t, newFakeHive())
+	p, err := ParseUrl("hive2://" + server.addr() + "/sales;auth=noSasl?hive.exec.parallel=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewConnector(p).Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hc := conn.(*hiveConn)
+	stmt, _ := hc.Prepare("set hive.exec.parallel=false")
+	if _, err := stmt.Exec(nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := hc.ResetSession(ctx); err != driver.ErrBadConn {
+		t.Errorf("ResetSession with a cancelled context = %v, want %v", err, driver.ErrBadConn)
+	}
+}
+
+func TestSessionResetDiscard(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		opts   []ConnectorOption
+		sql    string
+		opened int
+		// executed are the statements run before select 2, sql when empty.
+		executed string
+	}{
+		{"restore cannot unset", "", nil, "set hive.undefined.setting=1", 2, "set hive.undefined.setting;set hive.undefined.setting=1"},
+		{"restore cannot remove jars", "", nil, "add jar hdfs:///udf.jar", 2, ""},
+		{"discard", ";sessionReset=discard", nil, "use other", 2, ""},
+		{"discard option", ";sessionReset=none", []ConnectorOption{WithSessionReset(SessionResetDiscard)}, "use other", 2, ""},
+		{"none", ";sessionReset=none", nil, "add jar hdfs:///udf.jar", 1, ""},
+		{"unchanged", ";sessionReset=discard", nil, "select 1", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hive := newFakeHive()
+			db := openResetDB(t, startFakeServer(t, hive), tt.params, tt.opts...)
+			if _, err := db.Exec(tt.sql); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec("select 2"); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.executed
+			if want == "" {
+				want = tt.sql
+			}
+			if executed := hive.executed(); strings.Join(executed, ";") != want+";select 2" {
+				t.Errorf("executed %q", executed)
+			}
+			if opened := hive.opened(); opened != tt.opened {
+				t.Errorf("opened %d sessions, want %d", opened, tt.opened)
+			}
+		})
+	}
+}
+
+func TestSessionResetParam(t *testing.T) {
+	p, _ := ParseUrl("hive2://hs2.invalid:10000/default;auth=noSasl;sessionReset=sometimes")
+	if _, err := NewConnector(p).Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid sessionReset") {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
@@ -4,17 +4,27 @@ import (
 	"context"
 	"database/sql/driver"
 	"errors"
-	"fmt"
 	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
 	"strconv"
 )
 
 type hiveStmt struct {
-	hc         *hiveConn
-	sql        string
+	hc  *hiveConn
+	sql string
+	// conf is the confOverlay of the statement being run, see WithConf.
+	conf map[string]string
+	// untracked statements are run by the driver itself and do not count as changes to
+	// the session state.
+	untracked  bool
 	stmtHandle *tcliservice.TOperationHandle
 	fetchSize  int
 
+	queryIDFetched bool
+	queryIDValue   string
+	// modifiedRows is the number of rows the finished statement modified, -1 when the
+	// server does not tell.
+	modifiedRows int64
+
 	isCancelled, isQueryClosed, isExecuteStatementFailed, isOperationComplete bool
 }
 
@@ -24,10 +34,11 @@ func (hs *hiveStmt) closeClientOperation() error {
 		closeReq.OperationHandle = hs.stmtHandle
 		closeResp, err := hs.hc.client.CloseOperation(context.Background(), closeReq)
 		if err != nil {
+			hs.hc.checkError(err)
 			return err
 		}
 		if !verifySuccessWithInfo(closeResp.GetStatus()) {
-			return fmt.Errorf("Error from server: %s ", closeResp.Status.String())
+			return hs.hc.serverError(closeResp.Status)
 		}
 	}
 	hs.isQueryClosed = true
@@ -45,91 +56,212 @@ func (hs *hiveStmt) initFlags() {
 	hs.isQueryClosed = false
 	hs.isExecuteStatementFailed = false
 	hs.isOperationComplete = false
+	hs.queryIDFetched = false
+	hs.queryIDValue = ""
+	hs.modifiedRows = -1
 }
 
-func (hs *hiveStmt) runAsyncOnServer(sql string) error {
+func (hs *hiveStmt) runAsyncOnServer(ctx context.Context, sql string) error {
 	if err := hs.closeClientOperation(); err != nil {
 		return err
 	}
 	hs.initFlags()
+	if hs.hc.substitute && !hs.untracked && ctx.Value(substitutedKey{}) == nil {
+		var err error
+		if sql, err = hs.hc.vars.Substitute(sql); err != nil {
+			return err
+		}
+	}
+	if !hs.untracked {
+		hs.hc.savePriorValue(ctx, sql)
+		hs.hc.trackStatement(sql)
+	}
+	err := hs.executeStatement(ctx, sql)
+	if err != nil && hs.hc.expired {
+		// The server lost the session before starting the statement, so it is safe to
+		// run it again in a new one.
+		err = hs.executeStatement(ctx, sql)
+	}
+	if err == nil && hs.hc.substitute {
+		// Later statements see the variables of SET hivevar:name=value, as in the CLI.
+		hs.hc.vars.trackSet(sql)
+	}
+	return err
+}
+
+func (hs *hiveStmt) executeStatement(ctx context.Context, sql string) error {
+	if err := hs.hc.ensureSession(ctx); err != nil {
+		return err
+	}
 	execReq := tcliservice.NewTExecuteStatementReq()
 	execReq.SessionHandle = hs.hc.sessHandle
 	execReq.Statement = sql
-	execReq.RunAsync = true
-	execResp, err := hs.hc.client.ExecuteStatement(hs.hc.ctx, execReq)
+	execReq.ConfOverlay = hs.conf
+	execReq.RunAsync = hs.hc.runAsync
+	execResp, err := hs.hc.client.ExecuteStatement(ctx, execReq)
 	if err != nil {
+		hs.hc.checkError(err)
 		hs.isExecuteStatementFailed = true
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 	if !verifySuccessWithInfo(execResp.GetStatus()) {
-		return fmt.Errorf("Error from server: %s ", execResp.Status.String())
+		return hs.hc.serverError(execResp.Status)
 	}
 	hs.stmtHandle = execResp.OperationHandle
 	hs.isExecuteStatementFailed = false
 	return nil
 }
 
-func (hs *hiveStmt) waitForOperationToComplete() (err error) {
+// waitForOperationToComplete polls the status of the statement until it finishes. When
+// ctx is done first, the statement is cancelled on the server and ctx.Err() returned.
+func (hs *hiveStmt) waitForOperationToComplete(ctx context.Context) (err error) {
 	statusReq := tcliservice.NewTGetOperationStatusReq()
 	statusReq.OperationHandle = hs.stmtHandle
+	if hs.hc.progress != nil && hs.hc.supports(featureProgressUpdates) {
+		getProgressUpdate := true
+		statusReq.GetProgressUpdate = &getProgressUpdate
+	}
 
 	var statusResp *tcliservice.TGetOperationStatusResp
 	for !hs.isOperationComplete {
-		statusResp, err = hs.hc.client.GetOperationStatus(hs.hc.ctx, statusReq)
+		if ctx.Err() != nil {
+			return hs.cancelOperation(ctx.Err())
+		}
+		statusResp, err = hs.hc.client.GetOperationStatus(ctx, statusReq)
 		if err != nil {
+			// The transport may be left half-read: the connection is bad, and closing
+			// it ends the statement along with the session.
+			hs.hc.checkError(err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 		if !verifySuccessWithInfo(statusResp.GetStatus()) {
-			return fmt.Errorf("Error from server: %s ", statusResp.Status.String())
+			return hs.hc.serverError(statusResp.Status)
 		}
-		if statusResp.IsSetOperationState() {
-			switch statusResp.GetOperationState() {
-			case tcliservice.TOperationState_CLOSED_STATE:
-				fallthrough
-			case tcliservice.TOperationState_FINISHED_STATE:
-				hs.isOperationComplete = true
-			case tcliservice.TOperationState_CANCELED_STATE:
-				return errors.New("Query was cancelled ")
-			case tcliservice.TOperationState_TIMEDOUT_STATE:
-				return errors.New("Query timed out after \" + queryTimeout + \" seconds ")
-			case tcliservice.TOperationState_ERROR_STATE:
-				return errors.New("msg: " + statusResp.GetErrorMessage() +
-					", sqlState:" + statusResp.GetSqlState() +
-					", errorCode:" + strconv.Itoa(int(statusResp.GetErrorCode())))
-
-			case tcliservice.TOperationState_UKNOWN_STATE:
-				return errors.New("Unknown query HY000 ")
-			default:
-
-			}
+		hs.reportProgress(statusResp)
+		if err := operationError(statusResp); err != nil {
+			return err
+		}
+		if operationFinished(statusResp) {
+			hs.isOperationComplete = true
+			hs.modifiedRows = hs.hc.modifiedRows(statusResp)
 		}
 	}
 	return nil
 }
 
+// cancelOperation cancels the running statement on the server and returns err, the
+// reason the caller stopped waiting for it.
+func (hs *hiveStmt) cancelOperation(err error) error {
+	cancelReq := tcliservice.NewTCancelOperationReq()
+	cancelReq.OperationHandle = hs.stmtHandle
+	cancelResp, cancelErr := hs.hc.client.CancelOperation(context.Background(), cancelReq)
+	if cancelErr != nil {
+		hs.hc.checkError(cancelErr)
+	} else if verifySuccessWithInfo(cancelResp.GetStatus()) {
+		hs.isCancelled = true
+	}
+	return err
+}
+
+// operationFinished reports whether the statement of resp completed successfully.
+func operationFinished(resp *tcliservice.TGetOperationStatusResp) bool {
+	if !resp.IsSetOperationState() {
+		return false
+	}
+	state := resp.GetOperationState()
+	return state == tcliservice.TOperationState_FINISHED_STATE || state == tcliservice.TOperationState_CLOSED_STATE
+}
+
+// operationError returns the error of a statement that failed, was cancelled or timed out.
+func operationError(resp *tcliservice.TGetOperationStatusResp) error {
+	switch resp.GetOperationState() {
+	case tcliservice.TOperationState_CANCELED_STATE:
+		return errors.New("Query was cancelled ")
+	case tcliservice.TOperationState_TIMEDOUT_STATE:
+		return errors.New("Query timed out after \" + queryTimeout + \" seconds ")
+	case tcliservice.TOperationState_ERROR_STATE:
+		return errors.New("msg: " + resp.GetErrorMessage() +
+			", sqlState:" + resp.GetSqlState() +
+			", errorCode:" + strconv.Itoa(int(resp.GetErrorCode())))
+	case tcliservice.TOperationState_UKNOWN_STATE:
+		return errors.New("Unknown query HY000 ")
+	}
+	return nil
+}
+
+// modifiedRows returns the number of rows the statement of resp modified, -1 when the
+// server does not tell.
+func (hc *hiveConn) modifiedRows(resp *tcliservice.TGetOperationStatusResp) int64 {
+	if hc.supports(featureModifiedRows) && resp.IsSetNumModifiedRows() {
+		return resp.GetNumModifiedRows()
+	}
+	return -1
+}
+
 func (hs *hiveStmt) NumInput() int {
 	return 0
 }
 
+// Exec runs the statement to completion without fetching any result set.
 func (hs *hiveStmt) Exec(args []driver.Value) (driver.Result, error) {
-	_, err := hs.Query(args)
-	if err != nil {
+	return hs.exec(context.Background())
+}
+
+func (hs *hiveStmt) exec(ctx context.Context) (driver.Result, error) {
+	if err := hs.runAsyncOnServer(ctx, hs.sql); err != nil {
 		return nil, err
 	}
-	return driver.ResultNoRows, nil
+	if err := hs.waitForOperationToComplete(ctx); err != nil {
+		return nil, err
+	}
+	return hiveResult{rowsAffected: hs.modifiedRows}, nil
 }
 
 func (hs *hiveStmt) Query(args []driver.Value) (driver.Rows, error) {
-	err := hs.runAsyncOnServer(hs.sql)
+	return hs.query(context.Background())
+}
+
+// query runs the statement; the rows wait for it and fetch its results with ctx.
+func (hs *hiveStmt) query(ctx context.Context) (driver.Rows, error) {
+	err := hs.runAsyncOnServer(ctx, hs.sql)
 	if err != nil {
 		return nil, err
 	}
 	hr := &hiveRows{
 		hiveStmt: hs,
+		ctx:      ctx,
 	}
-	err = hr.retrieveSchema()
-	if err != nil {
-		return nil, err
+	// Statements such as DDL have no schema to retrieve.
+	if hs.stmtHandle.GetHasResultSet() {
+		if err := hr.retrieveSchema(); err != nil {
+			return nil, err
+		}
 	}
 	return hr, nil
 }
+
+// ErrRowsAffectedUnknown is returned by RowsAffected when the server did not report the
+// number of rows a statement modified. Hive reports it from version 3, for ACID tables.
+var ErrRowsAffectedUnknown = errors.New("hive2: the server did not report the number of modified rows")
+
+// hiveResult is the result of Exec; rowsAffected is negative when unknown.
+type hiveResult struct {
+	rowsAffected int64
+}
+
+func (r hiveResult) LastInsertId() (int64, error) {
+	return 0, errors.New("hive2: LastInsertId is not supported")
+}
+
+func (r hiveResult) RowsAffected() (int64, error) {
+	if r.rowsAffected < 0 {
+		return 0, ErrRowsAffectedUnknown
+	}
+	return r.rowsAffected, nil
+}
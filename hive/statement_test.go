@@ -0,0 +1,136 @@
+package hive2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+func TestExecRowsAffected(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol tcliservice.TProtocolVersion
+		modified int64
+		want     int64
+		err      error
+	}{
+		{"reported", tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11, 3, 3, nil},
+		{"reported as unknown", tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11, -1, 0, ErrRowsAffectedUnknown},
+		{"older server", tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V10, 3, 0, ErrRowsAffectedUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hive := newFakeHive()
+			hive.protocol = tt.protocol
+			hive.setResult("update t set a = 1", &fakeResult{modified: tt.modified})
+			db := openFakeDB(t, startFakeServer(t, hive), "")
+			result, err := db.Exec("update t set a = 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := result.RowsAffected()
+			if n != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("RowsAffected() = %d, %v, want %d, %v", n, err, tt.want, tt.err)
+			}
+			if _, err := result.LastInsertId(); err == nil {
+				t.Error("LastInsertId should not be supported")
+			}
+		})
+	}
+}
+
+func TestStatementWithoutResultSet(t *testing.T) {
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	if _, err := db.Exec("create table t (a int)"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("drop table t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns, _ := rows.Columns(); len(columns) != 0 {
+		t.Errorf("columns %v", columns)
+	}
+	if rows.Next() {
+		t.Error("expected no rows")
+	}
+	if err := rows.Err(); err != nil {
+		t.Error(err)
+	}
+	rows.Close()
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if hive.metadataCalls != 0 {
+		t.Errorf("fetched the schema of %d statements without a result set", hive.metadataCalls)
+	}
+}
+
+func TestExecWithResultSet(t *testing.T) {
+	hive := newFakeHive()
+	hive.setResult("select 1", &fakeResult{columns: []string{"_c0"}, rows: [][]string{{"1"}}})
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	if _, err := db.Exec("select 1"); err != nil {
+		t.Fatal(err)
+	}
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if hive.metadataCalls != 0 {
+		t.Error("Exec fetched the schema")
+	}
+}
+
+func TestExecContextDeadline(t *testing.T) {
+	hive := newFakeHive()
+	hive.setResult("insert into t select * from big", &fakeResult{running: 1 << 30})
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.ExecContext(ctx, "insert into t select * from big")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ExecContext did not stop at the deadline")
+	}
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if hive.cancelCalls != 1 {
+		t.Error("the statement was not cancelled on the server")
+	}
+}
+
+func TestQueryContextCancel(t *testing.T) {
+	hive := newFakeHive()
+	hive.setResult("select 1", &fakeResult{columns: []string{"_c0"}, rows: [][]string{{"1"}}, running: 1 << 30})
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, err := db.QueryContext(ctx, "select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if rows.Next() {
+		t.Fatal("expected no rows")
+	}
+	if err := rows.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	hive.mu.Lock()
+	defer hive.mu.Unlock()
+	if hive.cancelCalls != 1 {
+		t.Error("the statement was not cancelled on the server")
+	}
+}
@@ -0,0 +1,514 @@
+package hive2
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StructScanner scans the rows of a result set into structs. A struct field receives the
+// column named by its hive:"name" tag, or by the field name without a tag; hive:"-"
+// skips the field, and the fields of embedded structs count as fields of the struct.
+// Names match case-insensitively, and a field without a column of its own name also
+// matches a table.column name by its column part; several such columns for one field,
+// such as a.id and b.id for ID, are an error. Columns without a field and fields
+// without a column are left alone.
+//
+// ARRAY, MAP and STRUCT columns, which HiveServer2 sends as JSON, fill slices, maps and
+// structs, nested as deep as the column type is. TIMESTAMP and DATE columns fill
+// time.Time fields. A NULL leaves a field at its zero value, or sets a pointer field to
+// nil. Fields implementing sql.Scanner scan the column themselves.
+type StructScanner struct {
+	rows   *sql.Rows
+	typ    reflect.Type
+	fields [][]int
+	types  []string
+}
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// NewStructScanner returns a scanner of rows into structs of the type dest points to,
+// checking up front that the type of each column suits the field it fills and that no
+// field is filled by several table.column columns.
+func NewStructScanner(rows *sql.Rows, dest interface{}) (*StructScanner, error) {
+	typ := reflect.TypeOf(dest)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("hive2: scanning into %T, need a pointer to a struct", dest)
+	}
+	typ = typ.Elem()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	s := &StructScanner{rows: rows, typ: typ}
+	fields := structFields(typ)
+	// A field is filled by the column of its name, else by the only table.column one.
+	exact := map[string]bool{}
+	suffixed := map[string][]string{}
+	for _, column := range columns {
+		name := strings.ToLower(column.Name())
+		if _, ok := fields[name]; ok {
+			exact[name] = true
+		} else if dot := strings.LastIndex(name, "."); dot >= 0 {
+			if _, ok := fields[name[dot+1:]]; ok {
+				suffixed[name[dot+1:]] = append(suffixed[name[dot+1:]], column.Name())
+			}
+		}
+	}
+	for _, column := range columns {
+		name := strings.ToLower(column.Name())
+		index, ok := fields[name]
+		if !ok {
+			if dot := strings.LastIndex(name, "."); dot >= 0 && !exact[name[dot+1:]] {
+				key := name[dot+1:]
+				if index, ok = fields[key]; ok && len(suffixed[key]) > 1 {
+					return nil, fmt.Errorf("hive2: columns %s all fill field %s",
+						strings.Join(suffixed[key], ", "), fieldName(typ, index))
+				}
+			}
+		}
+		if ok {
+			field := typ.FieldByIndex(index)
+			if !scannable(column.DatabaseTypeName(), field.Type) {
+				return nil, fmt.Errorf("hive2: column %s of type %s cannot be scanned into field %s of type %s",
+					column.Name(), column.DatabaseTypeName(), fieldName(typ, index), field.Type)
+			}
+		}
+		s.fields = append(s.fields, index)
+		s.types = append(s.types, column.DatabaseTypeName())
+	}
+	return s, nil
+}
+
+// Scan scans the current row into the struct dest points to, which must be of the type
+// given to NewStructScanner.
+func (s *StructScanner) Scan(dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != s.typ {
+		return fmt.Errorf("hive2: scanning into %T, need a *%s", dest, s.typ)
+	}
+	values := make([]interface{}, len(s.fields))
+	ptrs := make([]interface{}, len(s.fields))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := s.rows.Scan(ptrs...); err != nil {
+		return err
+	}
+	columns, _ := s.rows.Columns()
+	for i, index := range s.fields {
+		if index == nil {
+			continue
+		}
+		field := fieldByIndex(v.Elem(), index)
+		if err := assignColumn(field, values[i], s.types[i]); err != nil {
+			return fmt.Errorf("hive2: column %s: %v", columns[i], err)
+		}
+	}
+	return nil
+}
+
+// ScanAll scans the remaining rows into the slice of structs, or of pointers to structs,
+// that dest points to, and closes rows.
+func ScanAll(rows *sql.Rows, dest interface{}) error {
+	defer rows.Close()
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("hive2: scanning into %T, need a pointer to a slice", dest)
+	}
+	slice := v.Elem()
+	elem := slice.Type().Elem()
+	structType := elem
+	if elem.Kind() == reflect.Ptr {
+		structType = elem.Elem()
+	}
+	s, err := NewStructScanner(rows, reflect.New(structType).Interface())
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		item := reflect.New(structType)
+		if err := s.Scan(item.Interface()); err != nil {
+			return err
+		}
+		if elem.Kind() == reflect.Ptr {
+			slice.Set(reflect.Append(slice, item))
+		} else {
+			slice.Set(reflect.Append(slice, item.Elem()))
+		}
+	}
+	return rows.Err()
+}
+
+// structFields returns the index of the fields of typ by their lower case name.
+func structFields(typ reflect.Type) map[string][]int {
+	fields := map[string][]int{}
+	var walk func(t reflect.Type, prefix []int)
+	walk = func(t reflect.Type, prefix []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("hive")
+			if tag == "-" {
+				continue
+			}
+			index := append(append([]int(nil), prefix...), i)
+			if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+				walk(field.Type, index)
+				continue
+			}
+			if field.PkgPath != "" {
+				// Unexported.
+				continue
+			}
+			name := tag
+			if name == "" {
+				name = field.Name
+			}
+			// Outer fields hide those of embedded structs.
+			if _, ok := fields[strings.ToLower(name)]; !ok || len(index) < len(fields[strings.ToLower(name)]) {
+				fields[strings.ToLower(name)] = index
+			}
+		}
+	}
+	walk(typ, nil)
+	return fields
+}
+
+func fieldName(typ reflect.Type, index []int) string {
+	var names []string
+	for _, i := range index {
+		field := typ.Field(i)
+		names = append(names, field.Name)
+		typ = field.Type
+	}
+	return strings.Join(names, ".")
+}
+
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		v = v.Field(i)
+	}
+	return v
+}
+
+// scannable reports whether a column of the Hive type typeName can fill a field of type t.
+func scannable(typeName string, t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(scannerType) || t.Kind() == reflect.Interface {
+		return true
+	}
+	if t.Kind() == reflect.Ptr {
+		return scannable(typeName, t.Elem())
+	}
+	kind := t.Kind()
+	isString := kind == reflect.String
+	isBytes := kind == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+	switch typeName {
+	case "BOOLEAN":
+		return kind == reflect.Bool || isString
+	case "TINYINT", "SMALLINT", "INT", "BIGINT":
+		return isInt(kind) || isUint(kind) || isFloat(kind) || isString
+	case "FLOAT", "DOUBLE", "DECIMAL":
+		return isFloat(kind) || isString
+	case "STRING", "VARCHAR", "CHAR":
+		return isString || isBytes
+	case "BINARY":
+		return isString || isBytes
+	case "TIMESTAMP", "DATE", "TIMESTAMP WITH LOCAL TIME ZONE":
+		return t == timeType || isString
+	case "ARRAY":
+		return kind == reflect.Slice || kind == reflect.Array || isString
+	case "MAP":
+		return kind == reflect.Map || isString
+	case "STRUCT":
+		return kind == reflect.Struct && t != timeType || kind == reflect.Map || isString
+	case "INTERVAL_YEAR_MONTH", "INTERVAL_DAY_TIME", "UNIONTYPE":
+		return isString
+	}
+	// NULL columns and types the driver does not know fill anything.
+	return true
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uint64
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// assignColumn sets field to the value of a column of the Hive type typeName.
+func assignColumn(field reflect.Value, value interface{}, typeName string) error {
+	if scanner, ok := field.Addr().Interface().(sql.Scanner); ok {
+		return scanner.Scan(value)
+	}
+	switch typeName {
+	case "ARRAY", "MAP", "STRUCT":
+		text, ok := value.(string)
+		if !ok || field.Kind() == reflect.String {
+			break
+		}
+		decoder := json.NewDecoder(strings.NewReader(quoteMapKeys(text)))
+		decoder.UseNumber()
+		var decoded interface{}
+		if err := decoder.Decode(&decoded); err != nil {
+			return err
+		}
+		return assignValue(field, decoded)
+	}
+	return assignValue(field, value)
+}
+
+// quoteMapKeys quotes the keys HiveServer2 writes bare in the text of complex values,
+// such as the numeric and boolean keys of {1:"a",2:"b"}, so that it decodes as JSON.
+func quoteMapKeys(text string) string {
+	var b strings.Builder
+	var objects []bool // whether each enclosing value is an object rather than an array
+	inString, escaped, expectKey := false, false, false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if inString {
+			b.WriteByte(c)
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if expectKey && c != ' ' && c != '"' && c != '}' {
+			end := strings.IndexByte(text[i:], ':')
+			if end < 0 {
+				end = len(text) - i
+			}
+			b.WriteString(strconv.Quote(strings.TrimSpace(text[i : i+end])))
+			i += end - 1
+			expectKey = false
+			continue
+		}
+		b.WriteByte(c)
+		switch c {
+		case '"':
+			inString = true
+			expectKey = false
+		case '{', '[':
+			objects = append(objects, c == '{')
+			expectKey = c == '{'
+		case '}', ']':
+			if len(objects) > 0 {
+				objects = objects[:len(objects)-1]
+			}
+			expectKey = false
+		case ',':
+			expectKey = len(objects) > 0 && objects[len(objects)-1]
+		case ' ':
+		default:
+			expectKey = false
+		}
+	}
+	return b.String()
+}
+
+// assignValue sets v to value, a column value or part of a decoded JSON value.
+func assignValue(v reflect.Value, value interface{}) error {
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.CanAddr() {
+		if scanner, ok := v.Addr().Interface().(sql.Scanner); ok {
+			return scanner.Scan(value)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := assignValue(elem.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+	if v.Type() == timeType {
+		if t, ok := value.(time.Time); ok {
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("cannot convert %T to time.Time", value)
+		}
+		t, err := parseHiveTime(text)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		switch value := value.(type) {
+		case string:
+			v.SetString(value)
+		case []byte:
+			v.SetString(string(value))
+		case time.Time:
+			v.SetString(value.Format(time.RFC3339Nano))
+		default:
+			v.SetString(fmt.Sprint(value))
+		}
+		return nil
+	case reflect.Bool:
+		switch value := value.(type) {
+		case bool:
+			v.SetBool(value)
+			return nil
+		case string:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(numberText(value), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(numberText(value), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(numberText(value), v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.Slice:
+		if b, ok := value.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		if s, ok := value.(string); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			break
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := assignValue(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok || len(items) > v.Len() {
+			break
+		}
+		for i, item := range items {
+			if err := assignValue(v.Index(i), item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			break
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(entries))
+		for key, entry := range entries {
+			k := reflect.New(v.Type().Key()).Elem()
+			if err := assignValue(k, key); err != nil {
+				return err
+			}
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := assignValue(e, entry); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, e)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			break
+		}
+		fields := structFields(v.Type())
+		for key, entry := range entries {
+			index, ok := fields[strings.ToLower(key)]
+			if !ok {
+				continue
+			}
+			if err := assignValue(fieldByIndex(v, index), entry); err != nil {
+				return fmt.Errorf("field %s: %v", key, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot convert %T to %s", value, v.Type())
+}
+
+// numberText returns the text of a numeric column or JSON value.
+func numberText(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case []byte:
+		return string(bytes.TrimSpace(value))
+	case json.Number:
+		return value.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// parseHiveTime parses the text of TIMESTAMP, DATE and TIMESTAMP WITH LOCAL TIME ZONE
+// values, such as "2024-01-01 12:00:00.123" or "2024-01-01 12:00:00.0 Europe/Paris".
+func parseHiveTime(text string) (time.Time, error) {
+	location := time.UTC
+	if fields := strings.Fields(text); len(fields) == 3 {
+		loc, err := time.LoadLocation(fields[2])
+		if err != nil {
+			return time.Time{}, err
+		}
+		location = loc
+		text = fields[0] + " " + fields[1]
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, text, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time", text)
+}
@@ -0,0 +1,182 @@
+package hive2
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mumuhhh/gohive2/hive/rpc/tcliservice"
+)
+
+type address struct {
+	City string `hive:"city"`
+	Zip  *int   `hive:"zip"`
+}
+
+type audit struct {
+	Updated time.Time `hive:"updated_at"`
+}
+
+type customer struct {
+	audit
+	ID       int64             `hive:"id"`
+	Name     string            // matched by field name
+	Active   bool              `hive:"active"`
+	Score    *float64          `hive:"score"`
+	Tags     []string          `hive:"tags"`
+	Counts   map[int]int64     `hive:"counts"`
+	Address  address           `hive:"address"`
+	Previous []address         `hive:"previous"`
+	Note     sql.NullString    `hive:"note"`
+	Ignored  string            `hive:"-"`
+	Extra    map[string]string `hive:"extra"`
+}
+
+func queryCustomers(t *testing.T, result *fakeResult) *sql.Rows {
+	t.Helper()
+	hive := newFakeHive()
+	hive.setResult("select * from customers", result)
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	rows, err := db.Query("select * from customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rows.Close() })
+	return rows
+}
+
+func TestScanAll(t *testing.T) {
+	rows := queryCustomers(t, &fakeResult{
+		columns: []string{"customers.ID", "customers.name", "customers.active", "customers.score", "customers.tags",
+			"customers.counts", "customers.address", "customers.previous", "customers.note", "customers.updated_at", "customers.unmapped"},
+		types: []tcliservice.TTypeId{tcliservice.TTypeId_BIGINT_TYPE, tcliservice.TTypeId_STRING_TYPE, tcliservice.TTypeId_BOOLEAN_TYPE,
+			tcliservice.TTypeId_DOUBLE_TYPE, tcliservice.TTypeId_ARRAY_TYPE, tcliservice.TTypeId_MAP_TYPE, tcliservice.TTypeId_STRUCT_TYPE,
+			tcliservice.TTypeId_ARRAY_TYPE, tcliservice.TTypeId_STRING_TYPE, tcliservice.TTypeId_TIMESTAMP_TYPE, tcliservice.TTypeId_STRING_TYPE},
+		rows: [][]string{
+			{"1", "Ada", "true", "9.5", `["a","b"]`, `{1:10,2:20}`, `{"city":"Paris","zip":75001}`,
+				`[{"city":"Lyon","zip":null}]`, "vip", "2024-01-02 03:04:05.5", "x"},
+			{"2", "Bob", "false", fakeNull, fakeNull, fakeNull, `{"City":"Oslo"}`, "[]", fakeNull, "2024-01-01", "y"},
+		},
+	})
+	var customers []customer
+	if err := ScanAll(rows, &customers); err != nil {
+		t.Fatal(err)
+	}
+	zip := 75001
+	score := 9.5
+	want := []customer{
+		{
+			audit:    audit{Updated: time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC)},
+			ID:       1,
+			Name:     "Ada",
+			Active:   true,
+			Score:    &score,
+			Tags:     []string{"a", "b"},
+			Counts:   map[int]int64{1: 10, 2: 20},
+			Address:  address{City: "Paris", Zip: &zip},
+			Previous: []address{{City: "Lyon"}},
+			Note:     sql.NullString{String: "vip", Valid: true},
+		},
+		{
+			audit:    audit{Updated: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+			ID:       2,
+			Name:     "Bob",
+			Address:  address{City: "Oslo"},
+			Previous: []address{},
+		},
+	}
+	if !reflect.DeepEqual(customers, want) {
+		t.Errorf("scanned\n%+v, want\n%+v", customers, want)
+	}
+}
+
+func TestQuoteMapKeys(t *testing.T) {
+	tests := map[string]string{
+		`{1:"a",2:"b"}`:                  `{"1":"a","2":"b"}`,
+		`{-1.5:null, true:[1,2]}`:        `{"-1.5":null, "true":[1,2]}`,
+		`[{1:{"a":"x:y,{2:3}"}},{}]`:     `[{"1":{"a":"x:y,{2:3}"}},{}]`,
+		`{"k\"1":{7:"v"}}`:               `{"k\"1":{"7":"v"}}`,
+		`{"city":"Paris","zip":75001}`:   `{"city":"Paris","zip":75001}`,
+		`["a,{b", 1, {"c":[{2:false}]}]`: `["a,{b", 1, {"c":[{"2":false}]}]`,
+	}
+	for text, want := range tests {
+		if got := quoteMapKeys(text); got != want {
+			t.Errorf("quoteMapKeys(%s) = %s, want %s", text, got, want)
+		}
+	}
+}
+
+func TestStructScannerValidation(t *testing.T) {
+	rows := queryCustomers(t, &fakeResult{
+		columns: []string{"id", "name"},
+		types:   []tcliservice.TTypeId{tcliservice.TTypeId_STRING_TYPE, tcliservice.TTypeId_STRING_TYPE},
+		rows:    [][]string{{"1", "Ada"}},
+	})
+	var c customer
+	if _, err := NewStructScanner(rows, &c); err == nil || !strings.Contains(err.Error(), "column id of type STRING") {
+		t.Errorf("expected a type error, got %v", err)
+	}
+	if _, err := NewStructScanner(rows, c); err == nil {
+		t.Error("expected an error for a struct value")
+	}
+}
+
+func TestStructScannerAmbiguousColumns(t *testing.T) {
+	var row struct {
+		ID   string `hive:"id"`
+		Name string `hive:"name"`
+	}
+	// a.id and b.id would both fill ID.
+	rows := queryCustomers(t, &fakeResult{columns: []string{"a.id", "b.id", "b.name"}, rows: [][]string{{"1", "2", "x"}}})
+	if _, err := NewStructScanner(rows, &row); err == nil || !strings.Contains(err.Error(), "a.id, b.id") {
+		t.Errorf("expected an ambiguity error, got %v", err)
+	}
+
+	// A column named exactly like the field wins.
+	rows = queryCustomers(t, &fakeResult{columns: []string{"b.id", "id", "name"}, rows: [][]string{{"2", "1", "x"}}})
+	s, err := NewStructScanner(rows, &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	if err := s.Scan(&row); err != nil {
+		t.Fatal(err)
+	}
+	if row.ID != "1" || row.Name != "x" {
+		t.Errorf("scanned %+v", row)
+	}
+}
+
+func TestScanLocalTimestamps(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	hive := newFakeHive()
+	hive.protocol = tcliservice.TProtocolVersion_HIVE_CLI_SERVICE_PROTOCOL_V11
+	hive.setResult("select ts, ts", &fakeResult{
+		columns: []string{"ts", "text"},
+		types:   []tcliservice.TTypeId{tcliservice.TTypeId_TIMESTAMPLOCALTZ_TYPE, tcliservice.TTypeId_TIMESTAMPLOCALTZ_TYPE},
+		rows:    [][]string{{"2024-01-01 12:00:00.5 Europe/Paris", "2024-01-01 12:00:00.5 Europe/Paris"}},
+	})
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	rows, err := db.Query("select ts, ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scanned []struct {
+		TS   time.Time
+		Text string
+	}
+	if err := ScanAll(rows, &scanned); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 1, 12, 0, 0, 5e8, paris)
+	if len(scanned) != 1 || !scanned[0].TS.Equal(want) || scanned[0].Text != "2024-01-01T12:00:00.5+01:00" {
+		t.Errorf("scanned %+v", scanned)
+	}
+}
@@ -1,6 +1,8 @@
 package hive2
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"regexp"
 	"strings"
@@ -26,6 +28,50 @@ type ConnParams struct {
 	SessionVar    map[string]string
 }
 
+// secretParams are the session variables hidden when ConnParams are printed or marshaled.
+var secretParams = map[string]bool{
+	"password":           true,
+	"trustStorePassword": true,
+	"jwt":                true,
+	"delegationToken":    true,
+}
+
+var secretParamPattern = regexp.MustCompile(`(password|trustStorePassword|jwt|delegationToken)=[^;?#&]*`)
+
+const redacted = "******"
+
+// Redacted returns a copy of p with the values of secret session variables, and the
+// secrets in JdbcUriString, replaced by asterisks.
+func (p ConnParams) Redacted() ConnParams {
+	sessionVar := make(map[string]string, len(p.SessionVar))
+	for k, v := range p.SessionVar {
+		if secretParams[k] {
+			v = redacted
+		}
+		sessionVar[k] = v
+	}
+	p.SessionVar = sessionVar
+	p.JdbcUriString = secretParamPattern.ReplaceAllString(p.JdbcUriString, "$1="+redacted)
+	return p
+}
+
+func (p ConnParams) String() string {
+	r := p.Redacted()
+	return fmt.Sprintf("{DBName:%s JdbcUriString:%s Addresses:%v HiveConf:%v HiveVar:%v SessionVar:%v}",
+		r.DBName, r.JdbcUriString, r.Addresses, r.HiveConf, r.HiveVar, r.SessionVar)
+}
+
+func (p ConnParams) GoString() string {
+	r := p.Redacted()
+	return fmt.Sprintf("hive2.ConnParams{DBName:%#v, JdbcUriString:%#v, Addresses:%#v, HiveConf:%#v, HiveVar:%#v, SessionVar:%#v}",
+		r.DBName, r.JdbcUriString, r.Addresses, r.HiveConf, r.HiveVar, r.SessionVar)
+}
+
+func (p ConnParams) MarshalJSON() ([]byte, error) {
+	type plain ConnParams
+	return json.Marshal(plain(p.Redacted()))
+}
+
 func ParseUrl(uri string) (*ConnParams, error) {
 	p := &ConnParams{
 		DBName:     "default",
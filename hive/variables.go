@@ -0,0 +1,277 @@
+package hive2
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// UndefinedVariable is what substitution does with a variable that has no value.
+type UndefinedVariable string
+
+const (
+	// UndefinedLeave leaves ${name} as it is, as Hive does.
+	UndefinedLeave UndefinedVariable = "leave"
+	// UndefinedEmpty replaces ${name} with nothing.
+	UndefinedEmpty UndefinedVariable = "empty"
+	// UndefinedError fails with an *UndefinedVariableError.
+	UndefinedError UndefinedVariable = "error"
+)
+
+// maxSubstitutionDepth bounds the substitution of variables in the values of variables,
+// as hive.variable.substitute.depth does.
+const maxSubstitutionDepth = 40
+
+// UndefinedVariableError is returned for a variable without a value under UndefinedError.
+type UndefinedVariableError struct {
+	Name string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("hive2: undefined variable ${%s}", e.Name)
+}
+
+// Variables substitutes variables in statements the way the Hive CLI does:
+//
+//	${hivevar:name}  the HiveVar name
+//	${hiveconf:key}  the HiveConf key
+//	${env:NAME}      the environment variable NAME
+//	${system:prop}   the system property prop, such as user.name or user.home
+//	${name}          the HiveVar name, else the HiveConf name
+//
+// Variables in the value of a variable are substituted too. \${ stands for a literal ${.
+type Variables struct {
+	HiveVar  map[string]string
+	HiveConf map[string]string
+	// System holds system properties; NewVariables fills in user.name, user.home,
+	// user.dir, os.name, os.arch and file.separator.
+	System map[string]string
+	// Env looks environment variables up; os.LookupEnv when nil.
+	Env func(name string) (string, bool)
+	// Undefined is what happens to variables without a value; UndefinedLeave when empty.
+	Undefined UndefinedVariable
+}
+
+// NewVariables returns the variables of params: its HiveVar and HiveConf, the environment
+// and the system properties of the process.
+func NewVariables(params *ConnParams) *Variables {
+	v := &Variables{
+		HiveVar:  map[string]string{},
+		HiveConf: map[string]string{},
+		System:   systemProperties(),
+	}
+	if params != nil {
+		for k, value := range params.HiveVar {
+			v.HiveVar[k] = value
+		}
+		for k, value := range params.HiveConf {
+			v.HiveConf[k] = value
+		}
+	}
+	return v
+}
+
+// systemProperties returns the Java system properties that make sense for a Go process.
+func systemProperties() map[string]string {
+	props := map[string]string{
+		"os.name":        runtime.GOOS,
+		"os.arch":        runtime.GOARCH,
+		"file.separator": string(filepath.Separator),
+	}
+	if u, err := user.Current(); err == nil {
+		props["user.name"] = u.Username
+		props["user.home"] = u.HomeDir
+	}
+	if dir, err := os.Getwd(); err == nil {
+		props["user.dir"] = dir
+	}
+	return props
+}
+
+// clone returns a copy of v whose maps can be changed independently.
+func (v *Variables) clone() *Variables {
+	c := *v
+	c.HiveVar = copyMap(v.HiveVar)
+	c.HiveConf = copyMap(v.HiveConf)
+	c.System = copyMap(v.System)
+	return &c
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// lookup returns the value of the variable in ${name}.
+func (v *Variables) lookup(name string) (string, bool) {
+	var value string
+	var ok bool
+	switch {
+	case strings.HasPrefix(name, "hivevar:"):
+		value, ok = v.HiveVar[strings.TrimPrefix(name, "hivevar:")]
+	case strings.HasPrefix(name, "hiveconf:"):
+		value, ok = v.HiveConf[strings.TrimPrefix(name, "hiveconf:")]
+	case strings.HasPrefix(name, "system:"):
+		value, ok = v.System[strings.TrimPrefix(name, "system:")]
+	case strings.HasPrefix(name, "env:"):
+		env := v.Env
+		if env == nil {
+			env = os.LookupEnv
+		}
+		value, ok = env(strings.TrimPrefix(name, "env:"))
+	default:
+		if value, ok = v.HiveVar[name]; !ok {
+			value, ok = v.HiveConf[name]
+		}
+	}
+	return value, ok
+}
+
+// Substitute returns text with its variables replaced by their values.
+func (v *Variables) Substitute(text string) (string, error) {
+	return v.substitute(text, 0)
+}
+
+func (v *Variables) substitute(text string, depth int) (string, error) {
+	if depth > maxSubstitutionDepth {
+		return "", fmt.Errorf("hive2: variable substitution deeper than %d levels", maxSubstitutionDepth)
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(text, "${")
+		if i < 0 {
+			break
+		}
+		if i > 0 && text[i-1] == '\\' {
+			b.WriteString(text[:i-1])
+			b.WriteString("${")
+			text = text[i+2:]
+			continue
+		}
+		end := variableEnd(text[i:])
+		if end < 0 {
+			// Not a variable, such as ${a b}: leave it as it is.
+			b.WriteString(text[:i+2])
+			text = text[i+2:]
+			continue
+		}
+		b.WriteString(text[:i])
+		name := text[i+2 : i+end]
+		value, ok := v.lookup(name)
+		switch {
+		case ok:
+			value, err := v.substitute(value, depth+1)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+		case v.Undefined == UndefinedError:
+			return "", &UndefinedVariableError{Name: name}
+		case v.Undefined == UndefinedEmpty:
+		default:
+			b.WriteString(text[i : i+end+1])
+		}
+		text = text[i+end+1:]
+	}
+	b.WriteString(text)
+	return b.String(), nil
+}
+
+// variableEnd returns the index of the } closing the variable text starts with, or -1
+// when text does not start with one. Like Hive's \$\{[^}$ ]+\}, names cannot be empty or
+// contain $ or white space.
+func variableEnd(text string) int {
+	for j := 2; j < len(text); j++ {
+		switch c := text[j]; {
+		case c == '}':
+			if j == 2 {
+				return -1
+			}
+			return j
+		case c == '$' || c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			return -1
+		}
+	}
+	return -1
+}
+
+// trackSet records the variable a SET hivevar:name=value or SET hiveconf:key=value
+// statement defines. It follows the statements of ExecScript and, when the connection
+// substitutes variables, every statement run on it.
+func (v *Variables) trackSet(statement string) {
+	fields := strings.Fields(statement)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "set") {
+		return
+	}
+	setting := strings.TrimSpace(statement[len(fields[0]):])
+	eq := strings.Index(setting, "=")
+	if eq < 0 {
+		return
+	}
+	name, value := strings.TrimSpace(setting[:eq]), strings.TrimSpace(setting[eq+1:])
+	switch {
+	case strings.HasPrefix(strings.ToLower(name), "hivevar:"):
+		v.HiveVar[name[len("hivevar:"):]] = value
+	case strings.HasPrefix(strings.ToLower(name), "hiveconf:"):
+		v.HiveConf[name[len("hiveconf:"):]] = value
+	case !strings.Contains(name, ":"):
+		v.HiveConf[name] = value
+	}
+}
+
+// WithVariableSubstitution substitutes variables in every statement before sending it,
+// with undefined as the policy for variables without a value. It overrides the
+// substituteVariables and undefinedVariables connection parameters.
+func WithVariableSubstitution(undefined UndefinedVariable) ConnectorOption {
+	return func(c *connector) {
+		c.undefined = undefined
+	}
+}
+
+// variables returns the variables of a new connection, and whether statements are
+// substituted.
+func (c *connector) variables() (*Variables, bool, error) {
+	vars := NewVariables(c.params)
+	if c.undefined != "" {
+		vars.Undefined = c.undefined
+		return vars, true, nil
+	}
+	substitute := false
+	if value, ok := c.params.SessionVar["substituteVariables"]; ok {
+		var err error
+		if substitute, err = strconv.ParseBool(value); err != nil {
+			return nil, false, fmt.Errorf("invalid substituteVariables %q: must be true or false", value)
+		}
+	}
+	if value, ok := c.params.SessionVar["undefinedVariables"]; ok {
+		switch undefined := UndefinedVariable(value); undefined {
+		case UndefinedLeave, UndefinedEmpty, UndefinedError:
+			vars.Undefined = undefined
+		default:
+			return nil, false, fmt.Errorf("invalid undefinedVariables %q: must be leave, empty or error", value)
+		}
+	}
+	return vars, substitute, nil
+}
+
+// SetVariables defines HiveVar variables for ExecScript and, when the connection
+// substitutes variables with substituteVariables=true or WithVariableSubstitution, for
+// the statements run on conn; otherwise those statements reach the server unchanged. The
+// variables are substituted by the driver only: the server does not know them.
+func SetVariables(ctx context.Context, conn *sql.Conn, vars map[string]string) error {
+	return withHiveConn(conn, func(hc *hiveConn) error {
+		for k, v := range vars {
+			hc.vars.HiveVar[k] = v
+		}
+		return nil
+	})
+}
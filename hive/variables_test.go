@@ -0,0 +1,155 @@
+package hive2
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubstitute(t *testing.T) {
+	vars := &Variables{
+		HiveVar:  map[string]string{"day": "2024-01-01", "table": "sales_${hivevar:region}", "region": "eu", "loop": "${loop}"},
+		HiveConf: map[string]string{"hive.exec.parallel": "true", "day": "shadowed"},
+		System:   map[string]string{"user.name": "etl"},
+		Env: func(name string) (string, bool) {
+			if name == "HOME" {
+				return "/home/etl", true
+			}
+			return "", false
+		},
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"select 1", "select 1"},
+		{"where day = '${hivevar:day}'", "where day = '2024-01-01'"},
+		{"where day = '${day}'", "where day = '2024-01-01'"},
+		{"from ${table}", "from sales_eu"},
+		{"${hiveconf:hive.exec.parallel} ${hive.exec.parallel}", "true true"},
+		{"${env:HOME}/${system:user.name}", "/home/etl/etl"},
+		{`select '\${day}', '${day}'`, "select '${day}', '2024-01-01'"},
+		{"select '${unknown}', '${env:MISSING}'", "select '${unknown}', '${env:MISSING}'"},
+		{"select '${day'", "select '${day'"},
+		{"select '${a b}', '${}', '${x$y}', '${day}'", "select '${a b}', '${}', '${x$y}', '2024-01-01'"},
+		{"select '${day\n}'", "select '${day\n}'"},
+	}
+	for _, tt := range tests {
+		got, err := vars.Substitute(tt.text)
+		if err != nil || got != tt.want {
+			t.Errorf("Substitute(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+		}
+	}
+
+	vars.Undefined = UndefinedEmpty
+	if got, _ := vars.Substitute("a${unknown}b"); got != "ab" {
+		t.Errorf("empty policy: %q", got)
+	}
+	if got, _ := vars.Substitute("a${not a name}b"); got != "a${not a name}b" {
+		t.Errorf("empty policy removed text that is not a variable: %q", got)
+	}
+	vars.Undefined = UndefinedError
+	var undefined *UndefinedVariableError
+	if _, err := vars.Substitute("a${hivevar:unknown}b"); !errors.As(err, &undefined) || undefined.Name != "hivevar:unknown" {
+		t.Errorf("error policy: %v", err)
+	}
+	if _, err := vars.Substitute("${loop}"); err == nil || !strings.Contains(err.Error(), "deeper") {
+		t.Errorf("expected a depth error, got %v", err)
+	}
+}
+
+func TestNewVariables(t *testing.T) {
+	params, err := ParseUrl("hive2://hs2.invalid:10000/default?hive.exec.parallel=true#day=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := NewVariables(params)
+	got, err := vars.Substitute("${day} ${hive.exec.parallel} ${system:os.name}")
+	if err != nil || strings.Contains(got, "${") {
+		t.Errorf("Substitute = %q, %v", got, err)
+	}
+}
+
+func TestStatementSubstitution(t *testing.T) {
+	hive := newFakeHive()
+	server := startFakeServer(t, hive)
+	db := openFakeDB(t, server, ";substituteVariables=true#day=2024-01-01")
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetVariables(ctx, conn, map[string]string{"table": "sales"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "insert into ${table} select * from s where day = '${hivevar:day}'"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	strict := openFakeDB(t, server, ";substituteVariables=true;undefinedVariables=error")
+	if _, err := strict.Exec("select ${unknown}"); err == nil {
+		t.Error("expected an undefined variable error")
+	}
+	// Without substitution the server gets the variables.
+	plain := openFakeDB(t, server, "#day=2024-01-01")
+	if _, err := plain.Exec("select '${day}'"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"insert into sales select * from s where day = '2024-01-01'", "select '${day}'"}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+	for _, params := range []string{";substituteVariables=maybe", ";undefinedVariables=ignore"} {
+		if err := openFakeDB(t, server, params).Ping(); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%s: expected an error, got %v", params, err)
+		}
+	}
+}
+
+func TestSubstituteAfterSet(t *testing.T) {
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), ";substituteVariables=true;undefinedVariables=error;sessionReset=none")
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("SET hivevar:x=1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("set y=2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("select ${x}, ${hiveconf:y}"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SET hivevar:x=1", "set y=2", "select 1, 2"}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+}
+
+func TestSetVariablesWithoutSubstitution(t *testing.T) {
+	hive := newFakeHive()
+	db := openFakeDB(t, startFakeServer(t, hive), "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SetVariables(ctx, conn, map[string]string{"table": "sales"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "select * from ${table}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExecScript(ctx, conn, strings.NewReader("select * from ${table};")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"select * from ${table}", "select * from sales"}
+	if executed := hive.executed(); !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed %q, want %q", executed, want)
+	}
+}
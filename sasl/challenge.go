@@ -3,7 +3,7 @@ package sasl
 import (
 	"errors"
 	"fmt"
-	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -20,8 +20,6 @@ const (
 	QopPrivacy = "auth-conf"
 )
 
-var challengeRegexp = regexp.MustCompile(",?([a-zA-Z0-9]+)=(\"([^\"]+)\"|([^,]+)),?")
-
 type Challenge struct {
 	Realm     string
 	Nonce     string
@@ -29,42 +27,104 @@ type Challenge struct {
 	Charset   string
 	Cipher    []string
 	Algorithm string
+	// MaxBuf is the largest security layer buffer the server accepts; 65536 unless
+	// the challenge says otherwise.
+	MaxBuf int
 }
 
-func ParseChallenge(challenge []byte) (*Challenge, error) {
-	ch := Challenge{}
+// DefaultMaxBuf is the maxbuf of a DIGEST-MD5 party that does not announce one.
+const DefaultMaxBuf = 65536
 
-	matched := challengeRegexp.FindAllSubmatch(challenge, -1)
-	if matched == nil {
-		return nil, fmt.Errorf("invalid token challenge: %s", challenge)
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	for _, m := range matched {
-		key := string(m[1])
-		val := string(m[3])
-		if val == "" {
-			val = string(m[2])
-		}
+func ParseChallenge(challenge []byte) (*Challenge, error) {
+	ch := Challenge{MaxBuf: DefaultMaxBuf}
+
+	directives, err := ParseDirectives(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token challenge: %v", err)
+	}
+	for key, val := range directives {
 		switch key {
 		case "realm":
 			ch.Realm = val
 		case "nonce":
 			ch.Nonce = val
 		case "qop":
-			ch.Qop = strings.Split(val, ",")
+			ch.Qop = splitList(val)
 		case "charset":
 			ch.Charset = val
 		case "cipher":
-			ch.Cipher = strings.Split(val, ",")
+			ch.Cipher = splitList(val)
 		case "algorithm":
 			ch.Algorithm = val
+		case "maxbuf":
+			maxBuf, err := strconv.Atoi(val)
+			if err != nil || maxBuf <= 0 {
+				return nil, fmt.Errorf("invalid token challenge: maxbuf %q", val)
+			}
+			ch.MaxBuf = maxBuf
 		default:
 		}
 	}
 
+	if ch.Nonce == "" {
+		return nil, errors.New("invalid token challenge: no nonce")
+	}
+	// RFC 2831 makes auth the default when the server offers no qop-options.
 	if len(ch.Qop) == 0 {
-		return nil, errors.New("invalid token challenge: no selected QOP")
+		ch.Qop = []string{QopAuthentication}
 	}
 
 	return &ch, nil
 }
+
+// ParseDirectives parses a DIGEST-MD5 challenge or response: a comma separated list of
+// name=value pairs, in which values may be quoted strings containing commas and the
+// backslash escapes of RFC 2831. Names are lower-cased.
+func ParseDirectives(b []byte) (map[string]string, error) {
+	directives := map[string]string{}
+	s := string(b)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return directives, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid directive in %q", b)
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quoted string in %q", b)
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		directives[name] = value.String()
+	}
+}
@@ -3,6 +3,8 @@ package sasl_test
 import (
 	"regexp"
 	"testing"
+
+	"github.com/mumuhhh/gohive2/sasl"
 )
 
 func TestREG(t *testing.T) {
@@ -13,3 +15,23 @@ func TestREG(t *testing.T) {
 	}
 
 }
+
+func TestParseChallengeEscapes(t *testing.T) {
+	ch, err := sasl.ParseChallenge([]byte(`realm="elwood\"s \\realm, inc",nonce="OA6MG9tEQGm2hh",qop="auth,auth-int",charset=utf-8,algorithm=md5-sess,maxbuf=1024`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Realm != `elwood"s \realm, inc` {
+		t.Errorf("Realm = %q", ch.Realm)
+	}
+	if ch.Nonce != "OA6MG9tEQGm2hh" || ch.Charset != "utf-8" || ch.Algorithm != "md5-sess" || ch.MaxBuf != 1024 {
+		t.Errorf("challenge = %+v", ch)
+	}
+	if len(ch.Qop) != 2 || ch.Qop[0] != sasl.QopAuthentication || ch.Qop[1] != sasl.QopIntegrity {
+		t.Errorf("Qop = %v", ch.Qop)
+	}
+
+	if _, err := sasl.ParseChallenge([]byte(`realm="unterminated,nonce="abc"`)); err == nil {
+		t.Error("expected an error for an unterminated quoted string")
+	}
+}
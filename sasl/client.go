@@ -1,5 +1,10 @@
 package sasl
 
+// Client is the client side of a SASL mechanism. Once complete, GetNegotiatedProperty
+// reports "sasl.qop" and, for mechanisms with a security layer, the buffer sizes
+// "sasl.maxbuffer" (the largest wrapped buffer the client accepts), "sasl.sendmaxbuffer"
+// (the largest the server accepts) and "sasl.rawsendsize" (the most data that fits in
+// one buffer sent to the server).
 type Client interface {
 	GetMechanismName() string
 	HasInitialResponse() bool
@@ -10,3 +15,12 @@ type Client interface {
 	GetNegotiatedProperty(propName string) (string, error)
 	Dispose()
 }
+
+// MaxMaxBuffer is the largest buffer size a SASL security layer can announce.
+const MaxMaxBuffer = 16777215
+
+// MaxBufferPolicy is implemented by clients with a security layer, to set the largest
+// wrapped buffer they announce and accept.
+type MaxBufferPolicy interface {
+	SetMaxBuffer(size int)
+}
@@ -87,8 +87,8 @@ func HmacMD5(key, text []byte) string {
 
 	/* store key in pads */
 	for i := 0; i < len(keyLocal); i++ {
-		ipad[i] = key[i]
-		opad[i] = key[i]
+		ipad[i] = keyLocal[i]
+		opad[i] = keyLocal[i]
 	}
 
 	/* XOR key with pads */
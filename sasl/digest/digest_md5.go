@@ -2,12 +2,14 @@ package sasldigest
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
-	"math/rand"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/mumuhhh/gohive2/sasl"
 )
@@ -33,14 +35,74 @@ type SecurityCtx interface {
 	Unwrap(outgoing []byte) ([]byte, error)
 }
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+// securityLayer is implemented by the security contexts to report how much wrapping
+// adds to a buffer.
+type securityLayer interface {
+	SecurityCtx
+	Overhead() int
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// randRead is replaced by tests that need crypto/rand to fail.
+var randRead = rand.Read
+
+// generateNonce returns n random letters and digits from crypto/rand.
+func generateNonce(n int) (string, error) {
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(b) < n {
+		if _, err := randRead(buf); err != nil {
+			return "", fmt.Errorf("DIGEST-MD5: reading random bytes: %v", err)
+		}
+		for _, r := range buf {
+			// Rejecting the bytes past the last multiple of len(letters) avoids bias.
+			if int(r) < 256-256%len(letters) && len(b) < n {
+				b = append(b, letters[int(r)%len(letters)])
+			}
+		}
+	}
+	return string(b), nil
+}
+
+// newCnonce is replaced by tests that need a known cnonce.
+var newCnonce = func() (string, error) {
+	return generateNonce(16)
+}
+
+// latin1 converts s to ISO 8859-1, reporting false if s has characters beyond it.
+func latin1(s string) (string, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff || r == utf8.RuneError {
+			return s, false
+		}
+		b = append(b, byte(r))
+	}
+	return string(b), true
+}
 
-func generateNonce(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// hashedString returns the form of s that is hashed into A1: ISO 8859-1 when possible,
+// otherwise UTF-8, which is only allowed if charset=utf-8 was negotiated.
+func hashedString(s string, useUTF8 bool) (string, error) {
+	converted, ok := latin1(s)
+	if !ok && !useUTF8 {
+		return "", fmt.Errorf("DIGEST-MD5: %q is not ISO 8859-1 and charset=utf-8 was not negotiated", s)
 	}
-	return string(b)
+	return converted, nil
+}
+
+// quote returns s as a quoted-string, escaping quotes and backslashes.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// rawSendSize is the largest buffer that, once wrapped, fits in the peer's maxbuf.
+func rawSendSize(layer securityLayer, maxBuf int) int {
+	if layer == nil {
+		return maxBuf
+	}
+	return maxBuf - layer.Overhead()
 }
 
 func h(s string) []byte {
@@ -55,6 +117,7 @@ func NewDigestMD5Client(authzid, username, password, protocol, serverName string
 		password:   password,
 		protocol:   protocol,
 		serverName: serverName,
+		maxBuf:     sasl.DefaultMaxBuf,
 	}
 }
 
@@ -64,13 +127,28 @@ type DigestMD5Client struct {
 	password   string
 	protocol   string
 	serverName string
+	allowedQop []string
+	maxBuf     int
 
 	Token *sasl.Challenge
 
 	completed bool
 	cnonce    string
+	qop       string
 	cipher    string
-	secCtx    SecurityCtx
+	utf8      bool
+	secCtx    securityLayer
+}
+
+// SetAllowedQop restricts the qualities of protection the client accepts; it selects the
+// strongest one offered by the server, and fails if none is allowed.
+func (m *DigestMD5Client) SetAllowedQop(qop []string) {
+	m.allowedQop = qop
+}
+
+// SetMaxBuffer sets the maxbuf announced to the server, 65536 by default.
+func (m *DigestMD5Client) SetMaxBuffer(size int) {
+	m.maxBuf = size
 }
 
 func (m *DigestMD5Client) GetMechanismName() string {
@@ -81,17 +159,34 @@ func (m *DigestMD5Client) HasInitialResponse() bool {
 	return false
 }
 
-func (m *DigestMD5Client) a1() string {
-	x := h(strings.Join([]string{m.username, m.Token.Realm, m.password}, ":"))
-	y := []string{string(x), m.Token.Nonce, m.cnonce}
-	if m.authzid != "" {
-		y = append(y, m.authzid)
+func (m *DigestMD5Client) a1() (string, error) {
+	return digestA1(m.username, m.Token.Realm, m.password, m.Token.Nonce, m.cnonce, m.authzid, m.utf8)
+}
+
+func (m *DigestMD5Client) compute(a1 string, initial bool) string {
+	return digestResponse(a1, m.Token.Nonce, m.cnonce, m.qop, m.protocol+"/"+m.serverName, initial)
+}
+
+// digestA1 computes A1 as defined in RFC 2831 section 2.1.2.1. useUTF8 tells whether
+// charset=utf-8 was negotiated.
+func digestA1(username, realm, password, nonce, cnonce, authzid string, useUTF8 bool) (string, error) {
+	var err error
+	secret := []string{username, realm, password}
+	for i := range secret {
+		if secret[i], err = hashedString(secret[i], useUTF8); err != nil {
+			return "", err
+		}
+	}
+	x := h(strings.Join(secret, ":"))
+	y := []string{string(x), nonce, cnonce}
+	if authzid != "" {
+		y = append(y, authzid)
 	}
-	return strings.Join(y, ":")
+	return strings.Join(y, ":"), nil
 }
 
-func (m *DigestMD5Client) a2(initial bool) string {
-	digestURI := m.protocol + "/" + m.serverName
+// digestA2 computes A2; the response value uses the AUTHENTICATE method, rspauth none.
+func digestA2(qop, digestURI string, initial bool) string {
 	var a2 []string
 	if initial {
 		a2 = append(a2, "AUTHENTICATE")
@@ -99,7 +194,7 @@ func (m *DigestMD5Client) a2(initial bool) string {
 		a2 = append(a2, "")
 	}
 	a2 = append(a2, digestURI)
-	if m.Token.Qop[0] == sasl.QopPrivacy || m.Token.Qop[0] == sasl.QopIntegrity {
+	if qop == sasl.QopPrivacy || qop == sasl.QopIntegrity {
 		a2 = append(a2, "00000000000000000000000000000000")
 	}
 	return strings.Join(a2, ":")
@@ -109,34 +204,33 @@ func kd(k, s string) []byte {
 	return h(k + ":" + s)
 }
 
-func (m *DigestMD5Client) compute(initial bool) string {
-	x := hex.EncodeToString(h(m.a1()))
+// digestResponse computes the response-value of the first authentication, which is
+// also the rspauth value when initial is false.
+func digestResponse(a1, nonce, cnonce, qop, digestURI string, initial bool) string {
+	x := hex.EncodeToString(h(a1))
 	y := strings.Join([]string{
-		m.Token.Nonce,
+		nonce,
 		fmt.Sprintf("%08x", 1),
-		m.cnonce,
-		m.Token.Qop[0],
-		hex.EncodeToString(h(m.a2(initial))),
+		cnonce,
+		qop,
+		hex.EncodeToString(h(digestA2(qop, digestURI, initial))),
 	}, ":")
 	return hex.EncodeToString(kd(x, y))
 }
 
+// chooseCipher returns the most preferred of the offered ciphers, or an empty string if
+// none is supported.
 func chooseCipher(options []string) string {
 	s := make(map[string]bool)
 	for _, c := range options {
-		s[c] = true
+		s[strings.TrimSpace(c)] = true
 	}
-
-	switch {
-	case s["rc4"]:
-		return "rc4"
-	case s["rc4-56"]:
-		return "rc4-56"
-	case s["rc4-40"]:
-		return "rc4-40"
-	default:
-		return ""
+	for _, c := range ciphers {
+		if s[c] {
+			return c
+		}
 	}
+	return ""
 }
 
 func (m *DigestMD5Client) challengeStep1(challenge []byte) ([]byte, error) {
@@ -145,42 +239,78 @@ func (m *DigestMD5Client) challengeStep1(challenge []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if m.Token.Charset != "" && !strings.EqualFold(m.Token.Charset, "utf-8") {
+		return nil, fmt.Errorf("DIGEST-MD5: unsupported charset %q", m.Token.Charset)
+	}
+	m.utf8 = m.Token.Charset != ""
 
-	m.cnonce = generateNonce(16)
+	m.qop = sasl.SelectQop(m.allowedQop, m.Token.Qop)
+	if m.qop == "" {
+		return nil, fmt.Errorf("DIGEST-MD5: server offers quality of protection %v, but only %v is allowed",
+			m.Token.Qop, m.allowedQop)
+	}
+	if m.qop == sasl.QopPrivacy {
+		if m.cipher = chooseCipher(m.Token.Cipher); m.cipher == "" {
+			return nil, fmt.Errorf("DIGEST-MD5: none of the ciphers %v is supported", m.Token.Cipher)
+		}
+	}
+
+	if m.cnonce, err = newCnonce(); err != nil {
+		return nil, err
+	}
+	a1, err := m.a1()
 	if err != nil {
 		return nil, err
 	}
+	rspdigest := m.compute(a1, true)
 
-	m.cipher = chooseCipher(m.Token.Cipher)
-	rspdigest := m.compute(true)
-
-	ret := fmt.Sprintf(`username="%s", realm="%s", nonce="%s", cnonce="%s", nc=%08x, qop=%s, digest-uri="%s/%s", response=%s, charset=utf-8`,
-		m.username, m.Token.Realm, m.Token.Nonce, m.cnonce, 1, m.Token.Qop[0], m.protocol, m.serverName, rspdigest)
-
+	username, realm := m.username, m.Token.Realm
+	if !m.utf8 {
+		// hashedString has already checked that they convert.
+		username, _ = latin1(username)
+		realm, _ = latin1(realm)
+	}
+	ret := fmt.Sprintf(`username=%s, realm=%s, nonce=%s, cnonce=%s, nc=%08x, qop=%s, digest-uri=%s, response=%s`,
+		quote(username), quote(realm), quote(m.Token.Nonce), quote(m.cnonce), 1, m.qop, quote(m.protocol+"/"+m.serverName), rspdigest)
+	if m.utf8 {
+		ret += ", charset=utf-8"
+	}
 	if m.cipher != "" {
 		ret += ", cipher=" + m.cipher
 	}
+	if m.authzid != "" {
+		ret += ", authzid=" + quote(m.authzid)
+	}
+	if m.maxBuf != sasl.DefaultMaxBuf {
+		ret += fmt.Sprintf(", maxbuf=%d", m.maxBuf)
+	}
 
 	return []byte(ret), nil
 }
 
 // challengeStep2 implements step two of RFC 2831.
 func (m *DigestMD5Client) challengeStep2(challenge []byte) error {
-	rspauth := strings.Split(string(challenge), "=")
+	rspauth := strings.SplitN(string(challenge), "=", 2)
 
-	if rspauth[0] != "rspauth" {
+	if len(rspauth) != 2 || rspauth[0] != "rspauth" {
 		return fmt.Errorf("rspauth not in '%s'", string(challenge))
 	}
 
-	if rspauth[1] != m.compute(false) {
+	a1, err := m.a1()
+	if err != nil {
+		return err
+	}
+	if rspauth[1] != m.compute(a1, false) {
 		return errors.New("rspauth did not match digest")
 	}
 
-	if m.Token.Qop[0] == sasl.QopPrivacy || m.Token.Qop[0] == sasl.QopIntegrity {
-		kic, kis := generateIntegrityKeys(m.a1())
-		if m.Token.Qop[0] == sasl.QopPrivacy {
-			kcc, kcs := generatePrivacyKeys(m.a1(), m.cipher)
-			m.secCtx = NewDigestPrivacy(kic, kis, kcc, kcs)
+	if m.qop == sasl.QopPrivacy || m.qop == sasl.QopIntegrity {
+		kic, kis := generateIntegrityKeys(a1)
+		if m.qop == sasl.QopPrivacy {
+			kcc, kcs := generatePrivacyKeys(a1, m.cipher)
+			if m.secCtx, err = NewDigestPrivacy(m.cipher, kic, kis, kcc, kcs); err != nil {
+				return err
+			}
 		} else {
 			m.secCtx = NewDigestIntegrity(kic, kis)
 		}
@@ -195,9 +325,14 @@ func (m *DigestMD5Client) EvaluateChallenge(challenge []byte) ([]byte, error) {
 		return nil, errors.New(fmt.Sprintf("DIGEST-MD5: Invalid digest-challenge length. Got: %d  Expected < 2048", length))
 	}
 	if strings.HasPrefix(string(challenge), "rspauth") {
-		err := m.challengeStep2(challenge)
+		if m.Token == nil {
+			return nil, errors.New("DIGEST-MD5: rspauth before the digest-challenge")
+		}
+		if err := m.challengeStep2(challenge); err != nil {
+			return nil, err
+		}
 		m.completed = true
-		return nil, err
+		return nil, nil
 	}
 	return m.challengeStep1(challenge)
 }
@@ -231,11 +366,13 @@ func (m *DigestMD5Client) GetNegotiatedProperty(propName string) (string, error)
 		if propName == "sasl.bound.server.name" {
 			return m.serverName, nil
 		} else if propName == "sasl.qop" {
-			return m.Token.Qop[0], nil
+			return m.qop, nil
 		} else if propName == "sasl.maxbuffer" {
-			return "65536", nil
+			return strconv.Itoa(m.maxBuf), nil
 		} else if propName == "sasl.sendmaxbuffer" {
-			return "0", nil
+			return strconv.Itoa(m.Token.MaxBuf), nil
+		} else if propName == "sasl.rawsendsize" {
+			return strconv.Itoa(rawSendSize(m.secCtx, m.Token.MaxBuf)), nil
 		} else {
 			return "", nil
 		}
@@ -259,4 +396,8 @@ func msgHMAC(mac hash.Hash, seq [4]byte, msg []byte) []byte {
 	return mac.Sum(nil)[:10]
 }
 
-var _ sasl.Client = (*DigestMD5Client)(nil)
+var (
+	_ sasl.Client          = (*DigestMD5Client)(nil)
+	_ sasl.QopPolicy       = (*DigestMD5Client)(nil)
+	_ sasl.MaxBufferPolicy = (*DigestMD5Client)(nil)
+)
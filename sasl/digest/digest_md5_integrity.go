@@ -34,6 +34,11 @@ func NewDigestIntegrity(kic, kis []byte) *DigestIntegrity {
 	}
 }
 
+// Overhead is what the wrapping adds to a buffer.
+func (d *DigestIntegrity) Overhead() int {
+	return macHMACLen + macMsgTypeLen + macSeqNumLen
+}
+
 func (d *DigestIntegrity) Wrap(dest []byte) ([]byte, error) {
 	inputLen := len(dest)
 	if inputLen == 0 {
@@ -57,15 +62,18 @@ func (d *DigestIntegrity) Unwrap(outgoing []byte) ([]byte, error) {
 		return make([]byte, 0), nil
 	}
 	input := outgoing[:]
+	if inputLen < macHMACLen+macMsgTypeLen+macSeqNumLen {
+		return nil, errors.New("HMAC Integrity Check failed: message too short")
+	}
 	// shave off last 16 bytes of message
 	seqBuf := lenEncodeBytes(d.readSeqNum)
 
 	dataLen := inputLen - macHMACLen - macMsgTypeLen - macSeqNumLen
 	expectedMac := msgHMAC(d.decodeMAC, seqBuf, input[:dataLen])
 
-	seqNumStart := inputLen - 2
-	msgTypeStart := seqNumStart - 4
-	origHashStart := msgTypeStart - 10
+	seqNumStart := inputLen - macSeqNumLen
+	msgTypeStart := seqNumStart - macMsgTypeLen
+	origHashStart := msgTypeStart - macHMACLen
 
 	if !bytes.Equal(expectedMac, input[origHashStart:origHashStart+macHMACLen]) ||
 		!bytes.Equal(macMsgType[:], input[msgTypeStart:msgTypeStart+macMsgTypeLen]) ||
@@ -2,13 +2,19 @@ package sasldigest
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/des"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rc4"
 	"errors"
+	"fmt"
 	"hash"
 )
 
+// ciphers lists the privacy ciphers of RFC 2831 from the most to the least preferred.
+var ciphers = []string{"3des", "rc4", "des", "rc4-56", "rc4-40"}
+
 func generatePrivacyKeys(a1 string, cipher string) ([]byte, []byte) {
 	sum := h(a1)
 	var n int
@@ -21,14 +27,71 @@ func generatePrivacyKeys(a1 string, cipher string) ([]byte, []byte) {
 		n = md5.Size
 	}
 
-	kcc := md5.Sum(append(sum[:n],
+	kcc := md5.Sum(append(sum[:n:n],
 		[]byte("Digest H(A1) to client-to-server sealing key magic constant")...))
-	kcs := md5.Sum(append(sum[:n],
+	kcs := md5.Sum(append(sum[:n:n],
 		[]byte("Digest H(A1) to server-to-client sealing key magic constant")...))
 
 	return kcc[:], kcs[:]
 }
 
+// addDesParity spreads the 56 bits of a 7 byte key over 8 bytes, the low bit of each
+// byte being an odd parity bit.
+func addDesParity(key []byte) []byte {
+	var bits uint64
+	for _, b := range key[:7] {
+		bits = bits<<8 | uint64(b)
+	}
+	expanded := make([]byte, 8)
+	for i := range expanded {
+		b := byte(bits>>(49-7*uint(i))) << 1
+		parity := byte(1)
+		for v := b; v != 0; v >>= 1 {
+			parity ^= v & 1
+		}
+		expanded[i] = b | parity
+	}
+	return expanded
+}
+
+// sealer encrypts or decrypts buffers in place; block ciphers keep their CBC state from
+// one buffer to the next, as RFC 2831 requires.
+type sealer struct {
+	blockSize int
+	crypt     func(buf []byte)
+}
+
+func newSealer(name string, key []byte, encrypt bool) (*sealer, error) {
+	var block cipher.Block
+	var err error
+	switch name {
+	case "rc4", "rc4-56", "rc4-40":
+		stream, err := rc4.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return &sealer{blockSize: 1, crypt: func(buf []byte) { stream.XORKeyStream(buf, buf) }}, nil
+	case "des":
+		block, err = des.NewCipher(addDesParity(key[:7]))
+	case "3des":
+		k1, k2 := addDesParity(key[:7]), addDesParity(key[7:14])
+		block, err = des.NewTripleDESCipher(append(append(append([]byte{}, k1...), k2...), k1...))
+	default:
+		return nil, fmt.Errorf("DIGEST-MD5: unsupported cipher %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	iv := key[8:16]
+	var mode cipher.BlockMode
+	if encrypt {
+		mode = cipher.NewCBCEncrypter(block, iv)
+	} else {
+		mode = cipher.NewCBCDecrypter(block, iv)
+	}
+	return &sealer{blockSize: mode.BlockSize(), crypt: func(buf []byte) { mode.CryptBlocks(buf, buf) }}, nil
+}
+
 type DigestPrivacy struct {
 	sendSeqNum int
 	readSeqNum int
@@ -36,23 +99,36 @@ type DigestPrivacy struct {
 	decodeMAC hash.Hash
 	encodeMAC hash.Hash
 
-	decryptor *rc4.Cipher
-	encryptor *rc4.Cipher
+	decryptor *sealer
+	encryptor *sealer
 }
 
-func NewDigestPrivacy(kic, kis, kcc, kcs []byte) *DigestPrivacy {
-	encryptor, _ := rc4.NewCipher(kcc)
-	decryptor, _ := rc4.NewCipher(kcs)
+// NewDigestPrivacy returns the auth-conf security context for cipher, one of 3des, des,
+// rc4, rc4-56 and rc4-40; kic and kcc protect the buffers sent, kis and kcs the ones received.
+func NewDigestPrivacy(cipher string, kic, kis, kcc, kcs []byte) (*DigestPrivacy, error) {
+	encryptor, err := newSealer(cipher, kcc, true)
+	if err != nil {
+		return nil, err
+	}
+	decryptor, err := newSealer(cipher, kcs, false)
+	if err != nil {
+		return nil, err
+	}
 
 	return &DigestPrivacy{
 		encryptor: encryptor,
 		decryptor: decryptor,
 		decodeMAC: hmac.New(md5.New, kis),
 		encodeMAC: hmac.New(md5.New, kic),
-	}
+	}, nil
 }
 
-func (d DigestPrivacy) Wrap(dest []byte) ([]byte, error) {
+// Overhead is the most the wrapping adds to a buffer.
+func (d *DigestPrivacy) Overhead() int {
+	return d.encryptor.blockSize - 1 + macHMACLen + macMsgTypeLen + macSeqNumLen
+}
+
+func (d *DigestPrivacy) Wrap(dest []byte) ([]byte, error) {
 	inputLen := len(dest)
 	if inputLen == 0 {
 		return make([]byte, 0), nil
@@ -60,16 +136,21 @@ func (d DigestPrivacy) Wrap(dest []byte) ([]byte, error) {
 	msg := dest[:]
 	seqBuf := lenEncodeBytes(d.sendSeqNum)
 
-	encryptedLen := inputLen + macHMACLen
+	// Block ciphers pad msg so that msg, padding and HMAC fill whole blocks; every
+	// padding byte holds the padding length.
+	padLen := 0
+	if bs := d.encryptor.blockSize; bs > 1 {
+		padLen = bs - (inputLen+macHMACLen)%bs
+	}
+	encryptedLen := inputLen + padLen + macHMACLen
 
 	mac := msgHMAC(d.encodeMAC, seqBuf, msg)
 
-	cipherBlock := make([]byte, encryptedLen)
-	copy(cipherBlock, msg)
-	copy(cipherBlock[inputLen:], mac)
-	d.encryptor.XORKeyStream(cipherBlock, cipherBlock)
 	wrapped := make([]byte, encryptedLen+macMsgTypeLen+macSeqNumLen)
-	copy(wrapped, cipherBlock)
+	copy(wrapped, msg)
+	copy(wrapped[inputLen:], bytes.Repeat([]byte{byte(padLen)}, padLen))
+	copy(wrapped[inputLen+padLen:], mac)
+	d.encryptor.crypt(wrapped[:encryptedLen])
 	copy(wrapped[encryptedLen:], macMsgType[0:2])
 	copy(wrapped[encryptedLen+macMsgTypeLen:], seqBuf[0:4])
 
@@ -77,13 +158,13 @@ func (d DigestPrivacy) Wrap(dest []byte) ([]byte, error) {
 	return wrapped, nil
 }
 
-func (d DigestPrivacy) Unwrap(outgoing []byte) ([]byte, error) {
+func (d *DigestPrivacy) Unwrap(outgoing []byte) ([]byte, error) {
 	inputLen := len(outgoing)
 	if inputLen == 0 {
 		return make([]byte, 0), nil
 	}
 	input := outgoing[:]
-	if inputLen < 4 {
+	if inputLen < macHMACLen+macMsgTypeLen+macSeqNumLen {
 		return nil, errors.New("invalid response from datanode: bad response length")
 	}
 
@@ -91,10 +172,20 @@ func (d DigestPrivacy) Unwrap(outgoing []byte) ([]byte, error) {
 	msgTypeStart := seqNumStart - macMsgTypeLen
 
 	encryptedLen := inputLen - macMsgTypeLen - macSeqNumLen
-	d.decryptor.XORKeyStream(input[:encryptedLen], input[:encryptedLen])
+	if encryptedLen%d.decryptor.blockSize != 0 {
+		return nil, errors.New("invalid response from datanode: bad response length")
+	}
+	d.decryptor.crypt(input[:encryptedLen])
 
 	origHash := input[encryptedLen-macHMACLen : encryptedLen]
 	encryptedLen -= macHMACLen
+	if d.decryptor.blockSize > 1 {
+		padLen := int(input[encryptedLen-1])
+		if padLen == 0 || padLen > d.decryptor.blockSize || padLen > encryptedLen {
+			return nil, errors.New("invalid response from datanode: bad padding")
+		}
+		encryptedLen -= padLen
+	}
 
 	seqBuf := lenEncodeBytes(d.readSeqNum)
 	expectedMac := msgHMAC(d.decodeMAC, seqBuf, input[:encryptedLen])
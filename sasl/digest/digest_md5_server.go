@@ -0,0 +1,232 @@
+package sasldigest
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+// DigestMD5Server is the server side of DIGEST-MD5 (RFC 2831), with the auth, auth-int
+// and auth-conf qualities of protection.
+type DigestMD5Server struct {
+	protocol   string
+	serverName string
+	realm      string
+	lookup     sasl.PasswordLookup
+	allowedQop []string
+	maxBuf     int
+
+	nonce      string
+	completed  bool
+	qop        string
+	authzid    string
+	sendMaxBuf int
+	secCtx     securityLayer
+}
+
+// NewDigestMD5Server returns a server for the digest-uri protocol/serverName, looking up
+// the passwords of users in realm.
+func NewDigestMD5Server(protocol, serverName, realm string, lookup sasl.PasswordLookup) *DigestMD5Server {
+	return &DigestMD5Server{
+		protocol:   protocol,
+		serverName: serverName,
+		realm:      realm,
+		lookup:     lookup,
+		maxBuf:     sasl.DefaultMaxBuf,
+	}
+}
+
+// SetMaxBuffer sets the maxbuf announced to clients, 65536 by default.
+func (m *DigestMD5Server) SetMaxBuffer(size int) {
+	m.maxBuf = size
+}
+
+// SetAllowedQop sets the qualities of protection offered to clients; all of them are
+// offered by default.
+func (m *DigestMD5Server) SetAllowedQop(qop []string) {
+	m.allowedQop = qop
+}
+
+func (m *DigestMD5Server) offeredQop() []string {
+	if len(m.allowedQop) == 0 {
+		return []string{sasl.QopAuthentication, sasl.QopIntegrity, sasl.QopPrivacy}
+	}
+	return m.allowedQop
+}
+
+func (m *DigestMD5Server) GetMechanismName() string {
+	return "DIGEST-MD5"
+}
+
+func (m *DigestMD5Server) EvaluateResponse(response []byte) ([]byte, error) {
+	if m.completed {
+		return nil, errors.New("DIGEST-MD5 authentication already completed")
+	}
+	if m.nonce == "" {
+		return m.challenge()
+	}
+	return m.verify(response)
+}
+
+func (m *DigestMD5Server) challenge() ([]byte, error) {
+	nonce, err := generateNonce(24)
+	if err != nil {
+		return nil, err
+	}
+	m.nonce = nonce
+	offered := m.offeredQop()
+	challenge := fmt.Sprintf(`realm=%s,nonce="%s",qop="%s",charset=utf-8,algorithm=md5-sess,maxbuf=%d`,
+		quote(m.realm), m.nonce, strings.Join(offered, ","), m.maxBuf)
+	if sasl.QopAllowed(offered, sasl.QopPrivacy) {
+		challenge += `,cipher="` + strings.Join(ciphers, ",") + `"`
+	}
+	return []byte(challenge), nil
+}
+
+func (m *DigestMD5Server) verify(response []byte) ([]byte, error) {
+	directives, err := sasl.ParseDirectives(response)
+	if err != nil {
+		return nil, fmt.Errorf("DIGEST-MD5: %v", err)
+	}
+	if directives["nonce"] != m.nonce {
+		return nil, errors.New("DIGEST-MD5: nonce does not match")
+	}
+	if directives["nc"] != "00000001" {
+		return nil, errors.New("DIGEST-MD5: unexpected nonce count")
+	}
+	useUTF8 := strings.EqualFold(directives["charset"], "utf-8")
+	if !useUTF8 {
+		for _, name := range []string{"username", "realm", "authzid"} {
+			directives[name] = fromLatin1(directives[name])
+		}
+	}
+	m.sendMaxBuf = sasl.DefaultMaxBuf
+	if maxBuf, ok := directives["maxbuf"]; ok {
+		if m.sendMaxBuf, err = strconv.Atoi(maxBuf); err != nil || m.sendMaxBuf <= 0 {
+			return nil, fmt.Errorf("DIGEST-MD5: invalid maxbuf %q", maxBuf)
+		}
+	}
+	if directives["realm"] != m.realm {
+		return nil, fmt.Errorf("DIGEST-MD5: unknown realm %q", directives["realm"])
+	}
+	digestURI := m.protocol + "/" + m.serverName
+	if !strings.EqualFold(directives["digest-uri"], digestURI) {
+		return nil, fmt.Errorf("DIGEST-MD5: digest-uri %q does not match %q", directives["digest-uri"], digestURI)
+	}
+	m.qop = directives["qop"]
+	if m.qop == "" {
+		m.qop = sasl.QopAuthentication
+	}
+	if !sasl.QopAllowed(m.offeredQop(), m.qop) {
+		return nil, fmt.Errorf("DIGEST-MD5: quality of protection %q was not offered", m.qop)
+	}
+	cipher := directives["cipher"]
+	if m.qop == sasl.QopPrivacy && chooseCipher([]string{cipher}) != cipher {
+		return nil, fmt.Errorf("DIGEST-MD5: unsupported cipher %q", cipher)
+	}
+	cnonce := directives["cnonce"]
+	if cnonce == "" {
+		return nil, errors.New("DIGEST-MD5: missing cnonce")
+	}
+
+	username := directives["username"]
+	password, err := m.lookup(username)
+	if err != nil {
+		return nil, errors.New("DIGEST-MD5: authentication failed")
+	}
+	a1, err := digestA1(username, m.realm, password, m.nonce, cnonce, directives["authzid"], useUTF8)
+	if err != nil {
+		return nil, err
+	}
+	expected := digestResponse(a1, m.nonce, cnonce, m.qop, directives["digest-uri"], true)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(directives["response"])) != 1 {
+		return nil, errors.New("DIGEST-MD5: authentication failed")
+	}
+
+	m.authzid = directives["authzid"]
+	if m.authzid == "" {
+		m.authzid = username
+	}
+	if m.qop == sasl.QopPrivacy || m.qop == sasl.QopIntegrity {
+		// The server signs and seals with the server-to-client keys.
+		kic, kis := generateIntegrityKeys(a1)
+		if m.qop == sasl.QopPrivacy {
+			kcc, kcs := generatePrivacyKeys(a1, cipher)
+			if m.secCtx, err = NewDigestPrivacy(cipher, kis, kic, kcs, kcc); err != nil {
+				return nil, err
+			}
+		} else {
+			m.secCtx = NewDigestIntegrity(kis, kic)
+		}
+	}
+	m.completed = true
+	return []byte("rspauth=" + digestResponse(a1, m.nonce, cnonce, m.qop, directives["digest-uri"], false)), nil
+}
+
+func (m *DigestMD5Server) IsComplete() bool {
+	return m.completed
+}
+
+func (m *DigestMD5Server) GetAuthorizationID() string {
+	return m.authzid
+}
+
+func (m *DigestMD5Server) Unwrap(incoming []byte) ([]byte, error) {
+	if !m.completed {
+		return nil, errors.New("DIGEST-MD5 authentication not completed")
+	}
+	if m.secCtx == nil {
+		return nil, errors.New("neither integrity nor privacy was negotiated")
+	}
+	return m.secCtx.Unwrap(incoming)
+}
+
+func (m *DigestMD5Server) Wrap(outgoing []byte) ([]byte, error) {
+	if !m.completed {
+		return nil, errors.New("DIGEST-MD5 authentication not completed")
+	}
+	if m.secCtx == nil {
+		return nil, errors.New("neither integrity nor privacy was negotiated")
+	}
+	return m.secCtx.Wrap(outgoing)
+}
+
+func (m *DigestMD5Server) GetNegotiatedProperty(propName string) (string, error) {
+	if m.completed {
+		if propName == "sasl.qop" {
+			return m.qop, nil
+		} else if propName == "sasl.maxbuffer" {
+			return strconv.Itoa(m.maxBuf), nil
+		} else if propName == "sasl.sendmaxbuffer" {
+			return strconv.Itoa(m.sendMaxBuf), nil
+		} else if propName == "sasl.rawsendsize" {
+			return strconv.Itoa(rawSendSize(m.secCtx, m.sendMaxBuf)), nil
+		} else {
+			return "", nil
+		}
+	} else {
+		return "", errors.New("DIGEST-MD5 authentication not completed")
+	}
+}
+
+func (m *DigestMD5Server) Dispose() {
+	m.secCtx = nil
+}
+
+var (
+	_ sasl.Server          = (*DigestMD5Server)(nil)
+	_ sasl.MaxBufferPolicy = (*DigestMD5Server)(nil)
+)
+
+// fromLatin1 decodes the ISO 8859-1 string s.
+func fromLatin1(s string) string {
+	r := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		r[i] = rune(s[i])
+	}
+	return string(r)
+}
@@ -0,0 +1,327 @@
+package sasldigest
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+func withCnonce(t *testing.T, cnonce string) {
+	t.Helper()
+	saved := newCnonce
+	newCnonce = func() (string, error) { return cnonce, nil }
+	t.Cleanup(func() { newCnonce = saved })
+}
+
+// TestRFC2831Examples replays the IMAP and ACAP exchanges of RFC 2831 section 4.
+func TestRFC2831Examples(t *testing.T) {
+	tests := []struct {
+		protocol, nonce, cnonce, response, rspauth string
+	}{
+		{"imap", "OA6MG9tEQGm2hh", "OA6MHXh6VqTrRk", "d388dad90d4bbd760a152321f2143af7", "ea40f60335c427b5527b84dbabcdfffd"},
+		{"acap", "OA9BSXrbuRhWay", "OA9BSuZWMSpW8m", "6084c6db3fede7352c551284490fd0fc", "2f0b3d7c3c2e486600ef710726aa2eae"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			withCnonce(t, tt.cnonce)
+			c := NewDigestMD5Client("", "chris", "secret", tt.protocol, "elwood.innosoft.com")
+			challenge := `realm="elwood.innosoft.com",nonce="` + tt.nonce + `",qop="auth",algorithm=md5-sess,charset=utf-8`
+			response, err := c.EvaluateChallenge([]byte(challenge))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := `username="chris", realm="elwood.innosoft.com", nonce="` + tt.nonce + `", cnonce="` + tt.cnonce +
+				`", nc=00000001, qop=auth, digest-uri="` + tt.protocol + `/elwood.innosoft.com", response=` + tt.response + `, charset=utf-8`
+			if string(response) != want {
+				t.Fatalf("response\n got %s\nwant %s", response, want)
+			}
+			if _, err := c.EvaluateChallenge([]byte("rspauth=" + tt.rspauth)); err != nil {
+				t.Fatal(err)
+			}
+			if !c.IsComplete() {
+				t.Fatal("client not complete")
+			}
+		})
+	}
+}
+
+func TestDigestRejectsBadRspauth(t *testing.T) {
+	c := NewDigestMD5Client("", "chris", "secret", "imap", "elwood.innosoft.com")
+	if _, err := c.EvaluateChallenge([]byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth"`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EvaluateChallenge([]byte("rspauth=ea40f60335c427b5527b84dbabcdfffd")); err == nil {
+		t.Error("rspauth for another cnonce accepted")
+	}
+	if c.IsComplete() {
+		t.Error("client completed despite a wrong rspauth")
+	}
+}
+
+func TestGenerateNonce(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		nonce, err := generateNonce(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nonce) != 16 || strings.Trim(nonce, letters) != "" {
+			t.Fatalf("bad nonce %q", nonce)
+		}
+		if seen[nonce] {
+			t.Fatalf("nonce %q repeated", nonce)
+		}
+		seen[nonce] = true
+	}
+}
+
+func TestGenerateNonceFailure(t *testing.T) {
+	saved := randRead
+	randRead = func([]byte) (int, error) { return 0, errors.New("entropy exhausted") }
+	t.Cleanup(func() { randRead = saved })
+
+	server := NewDigestMD5Server("hive", "hs2.example.com", "default", func(string) (string, error) {
+		return "secret", nil
+	})
+	if _, err := server.EvaluateResponse(nil); err == nil || !strings.Contains(err.Error(), "entropy exhausted") {
+		t.Errorf("server challenge: expected the crypto/rand error, got %v", err)
+	}
+	client := NewDigestMD5Client("", "hive", "secret", "hive", "hs2.example.com")
+	if _, err := client.EvaluateChallenge([]byte(`realm="default",nonce="abc",qop="auth",charset=utf-8,algorithm=md5-sess`)); err == nil ||
+		!strings.Contains(err.Error(), "entropy exhausted") {
+		t.Errorf("client response: expected the crypto/rand error, got %v", err)
+	}
+}
+
+func TestDigestQopSelection(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		offered string
+		want    string
+	}{
+		{nil, "auth,auth-int,auth-conf", sasl.QopPrivacy},
+		{nil, "auth", sasl.QopAuthentication},
+		{[]string{sasl.QopAuthentication, sasl.QopIntegrity}, "auth-conf, auth-int, auth", sasl.QopIntegrity},
+		{[]string{sasl.QopPrivacy}, "auth,auth-int", ""},
+	}
+	for _, tt := range tests {
+		c := NewDigestMD5Client("", "u", "p", "hive", "hs2")
+		c.SetAllowedQop(tt.allowed)
+		response, err := c.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="` + tt.offered + `",cipher="rc4-40,des"`))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("allowed %v, offered %s: expected an error", tt.allowed, tt.offered)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(response), "qop="+tt.want+",") {
+			t.Errorf("allowed %v, offered %s: response %s, want qop %s", tt.allowed, tt.offered, response, tt.want)
+		}
+		if tt.want == sasl.QopPrivacy && !strings.Contains(string(response), "cipher=des") {
+			t.Errorf("expected the des cipher to be preferred to rc4-40: %s", response)
+		}
+	}
+}
+
+// negotiate runs client against server until both are complete; a non-empty cipher
+// replaces the ciphers offered by the server.
+func negotiate(t *testing.T, client *DigestMD5Client, server *DigestMD5Server, cipher string) {
+	t.Helper()
+	challenge, err := server.EvaluateResponse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cipher != "" {
+		offered := `cipher="` + strings.Join(ciphers, ",") + `"`
+		challenge = bytes.Replace(challenge, []byte(offered), []byte(`cipher="`+cipher+`"`), 1)
+	}
+	response, err := client.EvaluateChallenge(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rspauth, err := server.EvaluateResponse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.EvaluateChallenge(rspauth); err != nil {
+		t.Fatal(err)
+	}
+	if !client.IsComplete() || !server.IsComplete() {
+		t.Fatal("negotiation not complete")
+	}
+}
+
+func TestDigestSecurityLayer(t *testing.T) {
+	lookup := func(string) (string, error) { return "pässword", nil }
+	for _, cipher := range append([]string{""}, ciphers...) {
+		name := cipher
+		if name == "" {
+			name = "auth-int"
+		}
+		t.Run(name, func(t *testing.T) {
+			server := NewDigestMD5Server("hive", "hs2", "HADOOP.COM", lookup)
+			qop := sasl.QopIntegrity
+			if cipher != "" {
+				qop = sasl.QopPrivacy
+			}
+			server.SetAllowedQop([]string{qop})
+			client := NewDigestMD5Client("etl", "jörg", "pässword", "hive", "hs2")
+			negotiate(t, client, server, cipher)
+			if client.cipher != cipher {
+				t.Fatalf("cipher = %q, want %q", client.cipher, cipher)
+			}
+			if got := server.GetAuthorizationID(); got != "etl" {
+				t.Errorf("authorization ID = %q", got)
+			}
+			if raw, _ := client.GetNegotiatedProperty("sasl.rawsendsize"); raw == "" || raw == "65536" {
+				t.Errorf("rawsendsize = %q", raw)
+			}
+
+			// Several messages in both directions exercise the sequence numbers and, for
+			// block ciphers, the chaining across buffers.
+			for i := 0; i < 4; i++ {
+				msg := bytes.Repeat([]byte{byte('a' + i)}, 3+i*5)
+				wrapped, err := client.Wrap(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cipher != "" && bytes.Contains(wrapped, msg) {
+					t.Fatal("privacy layer sent plain text")
+				}
+				got, err := server.Unwrap(wrapped)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("message %d = %q, want %q", i, got, msg)
+				}
+				wrapped, _ = server.Wrap(msg)
+				if got, err = client.Unwrap(wrapped); err != nil || !bytes.Equal(got, msg) {
+					t.Fatalf("reply %d = %q, %v", i, got, err)
+				}
+			}
+
+			// A replayed buffer has a stale sequence number.
+			wrapped, _ := client.Wrap([]byte("select 1"))
+			if _, err := server.Unwrap(wrapped); err != nil {
+				t.Fatal(err)
+			}
+			replay, _ := client.Wrap([]byte("select 2"))
+			replay[len(replay)-1]--
+			if _, err := server.Unwrap(replay); err == nil {
+				t.Error("replayed sequence number accepted")
+			}
+		})
+	}
+}
+
+func TestDigestCiphersNegotiated(t *testing.T) {
+	for _, cipher := range ciphers {
+		client := NewDigestMD5Client("", "u", "p", "hive", "hs2")
+		response, err := client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth-conf",cipher="` + cipher + `"`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(response), "cipher="+cipher) {
+			t.Errorf("cipher %s not selected: %s", cipher, response)
+		}
+	}
+	client := NewDigestMD5Client("", "u", "p", "hive", "hs2")
+	if _, err := client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth-conf",cipher="aes"`)); err == nil {
+		t.Error("expected an error without a supported cipher")
+	}
+}
+
+func TestDigestCharset(t *testing.T) {
+	lookup := func(string) (string, error) { return "pässword", nil }
+
+	// Without charset=utf-8 the strings travel and are hashed as ISO 8859-1.
+	withCnonce(t, "cnonce")
+	client := NewDigestMD5Client("", "jörg", "pässword", "hive", "hs2")
+	response, err := client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(response), "username=\"j\xf6rg\"") || strings.Contains(string(response), "charset") {
+		t.Errorf("response %q", response)
+	}
+	// With UTF-8 negotiated, ISO 8859-1 strings hash as they would without it.
+	utf8Client := NewDigestMD5Client("", "jörg", "pässword", "hive", "hs2")
+	utf8Response, err := utf8Client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth",charset=utf-8`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := func(r []byte) string { return string(r[strings.Index(string(r), "response="):]) }
+	if !strings.HasPrefix(digest(utf8Response), digest(response)[:len("response=")+32]) {
+		t.Errorf("ISO 8859-1 conversion differs: %s vs %s", response, utf8Response)
+	}
+
+	server := NewDigestMD5Server("hive", "hs2", "r", lookup)
+	server.nonce = "n"
+	if _, err := server.EvaluateResponse(response); err != nil {
+		t.Errorf("server rejects ISO 8859-1 response: %v", err)
+	}
+
+	client = NewDigestMD5Client("", "李", "p", "hive", "hs2")
+	if _, err := client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth"`)); err == nil {
+		t.Error("expected an error for a non ISO 8859-1 user name without charset=utf-8")
+	}
+	client = NewDigestMD5Client("", "李", "p", "hive", "hs2")
+	if _, err := client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth",charset=utf-8`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDigestQuotedRealm(t *testing.T) {
+	realm := `ACME "R&D" \ Hive, Inc.`
+	server := NewDigestMD5Server("hive", "hs2", realm, func(string) (string, error) { return "p", nil })
+	client := NewDigestMD5Client("", "u", "p", "hive", "hs2")
+	negotiate(t, client, server, "")
+	if client.Token.Realm != realm {
+		t.Errorf("client read realm %q, want %q", client.Token.Realm, realm)
+	}
+}
+
+func TestDigestMaxBuf(t *testing.T) {
+	client := NewDigestMD5Client("", "u", "p", "hive", "hs2")
+	server := NewDigestMD5Server("hive", "hs2", "r", func(string) (string, error) { return "p", nil })
+	server.SetAllowedQop([]string{sasl.QopIntegrity})
+	negotiate(t, client, server, "")
+	if got, _ := client.GetNegotiatedProperty("sasl.sendmaxbuffer"); got != "65536" {
+		t.Errorf("sendmaxbuffer = %s", got)
+	}
+	if got, _ := client.GetNegotiatedProperty("sasl.rawsendsize"); got != "65520" {
+		t.Errorf("rawsendsize = %s", got)
+	}
+
+	client = NewDigestMD5Client("", "u", "p", "hive", "hs2")
+	if _, err := client.EvaluateChallenge([]byte(`realm="r",nonce="n",qop="auth",maxbuf=1024`)); err != nil {
+		t.Fatal(err)
+	}
+	if client.Token.MaxBuf != 1024 {
+		t.Errorf("maxbuf = %d", client.Token.MaxBuf)
+	}
+	if _, err := NewDigestMD5Client("", "u", "p", "hive", "hs2").EvaluateChallenge([]byte(`realm="r",nonce="n",maxbuf=-1`)); err == nil {
+		t.Error("negative maxbuf accepted")
+	}
+}
+
+func TestAddDesParity(t *testing.T) {
+	key := addDesParity([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	for _, b := range key {
+		if b != 0xfe {
+			t.Fatalf("parity of all ones = %x", key)
+		}
+	}
+	key = addDesParity([]byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde})
+	want := []byte{0x13, 0x1a, 0x15, 0xce, 0x89, 0xd5, 0xf2, 0xbc}
+	if !bytes.Equal(key, want) {
+		t.Fatalf("addDesParity = %x, want %x", key, want)
+	}
+}
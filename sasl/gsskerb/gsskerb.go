@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/mumuhhh/gohive2/sasl"
 
@@ -20,6 +21,9 @@ type GssKerbClient struct {
 	protocol       string
 	serverName     string
 	kerberosClient *krb.Client
+	allowedQop     []string
+	maxBuf         int
+	sendMaxBuf     int
 
 	completed, finalHandshake, privacy, integrity bool
 	sessionKey                                    types.EncryptionKey
@@ -31,9 +35,27 @@ func NewGssKerbClient(authzID, protocol, serverName string, kerberosClient *krb.
 		protocol:       protocol,
 		serverName:     serverName,
 		kerberosClient: kerberosClient,
+		maxBuf:         defaultMaxBuf,
 	}
 }
 
+// defaultMaxBuf is the largest wrapped buffer the client accepts unless told otherwise.
+const defaultMaxBuf = 65536
+
+// wrapOverhead bounds what wrapping adds to a buffer: the 16 byte token header, and the
+// confounder and checksum of the largest encryption type.
+const wrapOverhead = 16 + 16 + 32
+
+// SetMaxBuffer sets the largest wrapped buffer the client accepts from the server.
+func (p *GssKerbClient) SetMaxBuffer(size int) {
+	p.maxBuf = size
+}
+
+// SetAllowedQop restricts the security layers the client accepts from the server.
+func (p *GssKerbClient) SetAllowedQop(qop []string) {
+	p.allowedQop = qop
+}
+
 func (p *GssKerbClient) GetMechanismName() string {
 	return "GSSAPI"
 }
@@ -48,7 +70,11 @@ func (p *GssKerbClient) EvaluateChallenge(challenge []byte) ([]byte, error) {
 	}
 
 	if !p.finalHandshake {
-		ticket, key, err := p.kerberosClient.GetServiceTicket(p.protocol + "/" + p.serverName)
+		spn := p.protocol
+		if p.serverName != "" {
+			spn += "/" + p.serverName
+		}
+		ticket, key, err := p.kerberosClient.GetServiceTicket(spn)
 		if err != nil {
 			return nil, err
 		}
@@ -71,23 +97,42 @@ func (p *GssKerbClient) EvaluateChallenge(challenge []byte) ([]byte, error) {
 		if len(data) != 4 {
 			return nil, fmt.Errorf("decoded data should have length for at this stage")
 		}
-		qopBits := data[0]
+		// The server offers a bit mask of security layers, the client answers with one.
+		var offered []string
+		if data[0]&1 != 0 {
+			offered = append(offered, sasl.QopAuthentication)
+		}
+		if data[0]&2 != 0 {
+			offered = append(offered, sasl.QopIntegrity)
+		}
+		if data[0]&4 != 0 {
+			offered = append(offered, sasl.QopPrivacy)
+		}
 		data[0] = 0
 		serverMaxLength := int(binary.BigEndian.Uint32(data))
-
-		switch qopBits {
-		case 2:
+		p.sendMaxBuf = serverMaxLength
+
+		var qopBits byte
+		switch sasl.SelectQop(p.allowedQop, offered) {
+		case sasl.QopAuthentication:
+			qopBits = 1
+		case sasl.QopIntegrity:
+			qopBits = 2
 			p.integrity = true
-		case 4:
+		case sasl.QopPrivacy:
+			qopBits = 4
 			p.integrity = true
 			p.privacy = true
+		default:
+			return nil, fmt.Errorf("no acceptable quality of protection offered by server: %v", offered)
 		}
 
 		header := make([]byte, 4)
 		maxLength := serverMaxLength
-		if serverMaxLength > 65536 {
-			maxLength = 65536
+		if serverMaxLength > p.maxBuf {
+			maxLength = p.maxBuf
 		}
+		p.maxBuf = maxLength
 
 		headerInt := (uint(qopBits) << 24) | uint(maxLength)
 
@@ -182,6 +227,15 @@ func (p *GssKerbClient) GetNegotiatedProperty(propName string) (string, error) {
 			} else {
 				return sasl.QopAuthentication, nil
 			}
+		} else if propName == "sasl.maxbuffer" {
+			return strconv.Itoa(p.maxBuf), nil
+		} else if propName == "sasl.sendmaxbuffer" {
+			return strconv.Itoa(p.sendMaxBuf), nil
+		} else if propName == "sasl.rawsendsize" {
+			if p.sendMaxBuf == 0 {
+				return "0", nil
+			}
+			return strconv.Itoa(p.sendMaxBuf - wrapOverhead), nil
 		} else {
 			return "", nil
 		}
@@ -193,4 +247,8 @@ func (p *GssKerbClient) GetNegotiatedProperty(propName string) (string, error) {
 func (p *GssKerbClient) Dispose() {
 }
 
-var _ sasl.Client = (*GssKerbClient)(nil)
+var (
+	_ sasl.Client          = (*GssKerbClient)(nil)
+	_ sasl.QopPolicy       = (*GssKerbClient)(nil)
+	_ sasl.MaxBufferPolicy = (*GssKerbClient)(nil)
+)
@@ -0,0 +1,90 @@
+package saslplain
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+// PlainServer verifies PLAIN credentials with a callback, typically against LDAP or a
+// password file.
+type PlainServer struct {
+	completed       bool
+	authorizationID string
+	verify          func(authorizationID, username, password string) error
+}
+
+// NewPlainServer returns a PLAIN server that accepts a client when verify returns nil.
+// An empty authorization identity given by the client defaults to its user name.
+func NewPlainServer(verify func(authorizationID, username, password string) error) *PlainServer {
+	return &PlainServer{
+		verify: verify,
+	}
+}
+
+func (p *PlainServer) GetMechanismName() string {
+	return "PLAIN"
+}
+
+func (p *PlainServer) EvaluateResponse(response []byte) ([]byte, error) {
+	if p.completed {
+		return nil, errors.New("PLAIN authentication already completed")
+	}
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, errors.New("PLAIN: invalid message format")
+	}
+	authorizationID, username, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if username == "" {
+		return nil, errors.New("PLAIN: no user name provided")
+	}
+	if authorizationID == "" {
+		authorizationID = username
+	}
+	if err := p.verify(authorizationID, username, password); err != nil {
+		return nil, err
+	}
+	p.authorizationID = authorizationID
+	p.completed = true
+	return nil, nil
+}
+
+func (p *PlainServer) IsComplete() bool {
+	return p.completed
+}
+
+func (p *PlainServer) GetAuthorizationID() string {
+	return p.authorizationID
+}
+
+func (p *PlainServer) Unwrap([]byte) ([]byte, error) {
+	if p.completed {
+		return nil, errors.New("PLAIN supports neither integrity nor privacy")
+	}
+	return nil, errors.New("PLAIN authentication not completed")
+}
+
+func (p *PlainServer) Wrap([]byte) ([]byte, error) {
+	if p.completed {
+		return nil, errors.New("PLAIN supports neither integrity nor privacy")
+	}
+	return nil, errors.New("PLAIN authentication not completed")
+}
+
+func (p *PlainServer) GetNegotiatedProperty(propName string) (string, error) {
+	if p.completed {
+		if propName == "sasl.qop" {
+			return sasl.QopAuthentication, nil
+		} else {
+			return "", nil
+		}
+	} else {
+		return "", errors.New("PLAIN authentication not completed")
+	}
+}
+
+func (p *PlainServer) Dispose() {
+}
+
+var _ sasl.Server = (*PlainServer)(nil)
@@ -0,0 +1,62 @@
+package sasl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// qopStrength orders the quality of protection values from weakest to strongest.
+var qopStrength = map[string]int{
+	QopAuthentication: 1,
+	QopIntegrity:      2,
+	QopPrivacy:        3,
+}
+
+// ParseQop parses a comma separated list of quality of protection values, such as
+// "auth-conf,auth-int".
+func ParseQop(s string) ([]string, error) {
+	var qop []string
+	for _, q := range strings.Split(s, ",") {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			continue
+		}
+		if _, ok := qopStrength[q]; !ok {
+			return nil, fmt.Errorf("invalid quality of protection %q", q)
+		}
+		qop = append(qop, q)
+	}
+	return qop, nil
+}
+
+// QopAllowed reports whether qop is in allowed. An empty allowed list accepts any value.
+func QopAllowed(allowed []string, qop string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, q := range allowed {
+		if q == qop {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectQop returns the strongest offered quality of protection that is allowed, or an
+// empty string if there is none.
+func SelectQop(allowed, offered []string) string {
+	selected := ""
+	for _, q := range offered {
+		q = strings.TrimSpace(q)
+		if QopAllowed(allowed, q) && qopStrength[q] > qopStrength[selected] {
+			selected = q
+		}
+	}
+	return selected
+}
+
+// QopPolicy is implemented by clients that negotiate a security layer, to restrict the
+// quality of protection they may select.
+type QopPolicy interface {
+	SetAllowedQop(qop []string)
+}
@@ -0,0 +1,55 @@
+package sasl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a Client for one connection. params holds the parsed connection
+// parameters and host is the name of the server being connected to.
+type Factory func(params map[string]string, host string) (Client, error)
+
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: map[string]Factory{}}
+
+// Register makes a SASL mechanism available by name. Names are case-insensitive. If
+// Register is called twice with the same name or if factory is nil, it panics.
+func Register(name string, factory Factory) {
+	factories.Lock()
+	defer factories.Unlock()
+	if factory == nil {
+		panic("sasl: Register factory is nil")
+	}
+	name = strings.ToUpper(name)
+	if _, dup := factories.m[name]; dup {
+		panic("sasl: Register called twice for mechanism " + name)
+	}
+	factories.m[name] = factory
+}
+
+// NewClient creates a client for the named mechanism using its registered factory.
+func NewClient(name string, params map[string]string, host string) (Client, error) {
+	factories.RLock()
+	factory, ok := factories.m[strings.ToUpper(name)]
+	factories.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", name)
+	}
+	return factory(params, host)
+}
+
+// Mechanisms returns a sorted list of the names of the registered mechanisms.
+func Mechanisms() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+	names := make([]string, 0, len(factories.m))
+	for name := range factories.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
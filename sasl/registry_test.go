@@ -0,0 +1,49 @@
+package sasl_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mumuhhh/gohive2/sasl"
+	saslplain "github.com/mumuhhh/gohive2/sasl/plain"
+)
+
+func TestRegister(t *testing.T) {
+	var gotParams map[string]string
+	var gotHost string
+	sasl.Register("x-sso-token", func(params map[string]string, host string) (sasl.Client, error) {
+		gotParams, gotHost = params, host
+		return saslplain.NewPlainClient("", params["ssoUser"], params["ssoToken"]), nil
+	})
+
+	client, err := sasl.NewClient("X-SSO-TOKEN", map[string]string{"ssoUser": "etl", "ssoToken": "t0k3n"}, "hs2.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetMechanismName() != "PLAIN" || gotHost != "hs2.example.com" || gotParams["ssoUser"] != "etl" {
+		t.Errorf("factory called with %v, %q", gotParams, gotHost)
+	}
+
+	found := false
+	for _, name := range sasl.Mechanisms() {
+		if name == "X-SSO-TOKEN" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Mechanisms() = %v", sasl.Mechanisms())
+	}
+
+	if _, err := sasl.NewClient("X-UNKNOWN", nil, "hs2"); err == nil {
+		t.Error("unknown mechanism should fail")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate Register should panic")
+		}
+	}()
+	sasl.Register("X-SSO-TOKEN", func(map[string]string, string) (sasl.Client, error) {
+		return nil, errors.New("unused")
+	})
+}
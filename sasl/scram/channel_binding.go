@@ -0,0 +1,50 @@
+package saslscram
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// ChannelBinding identifies the TLS channel a SCRAM exchange is bound to.
+type ChannelBinding struct {
+	Type string
+	Data []byte
+}
+
+// TLSUnique returns the tls-unique binding (RFC 5929) of a TLS 1.2 connection.
+func TLSUnique(cs tls.ConnectionState) (*ChannelBinding, error) {
+	if len(cs.TLSUnique) == 0 {
+		return nil, errors.New("tls-unique is not available for this connection")
+	}
+	return &ChannelBinding{Type: "tls-unique", Data: cs.TLSUnique}, nil
+}
+
+// TLSServerEndPoint returns the tls-server-end-point binding (RFC 5929), a hash of the
+// server certificate that also works through TLS terminating proxies sharing it.
+func TLSServerEndPoint(cs tls.ConnectionState) (*ChannelBinding, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("no server certificate for tls-server-end-point")
+	}
+	cert := cs.PeerCertificates[0]
+	h := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = crypto.SHA512
+	}
+	hash := h.New()
+	hash.Write(cert.Raw)
+	return &ChannelBinding{Type: "tls-server-end-point", Data: hash.Sum(nil)}, nil
+}
+
+// TLSExporter returns the tls-exporter binding (RFC 9266), the one defined for TLS 1.3.
+func TLSExporter(cs tls.ConnectionState) (*ChannelBinding, error) {
+	data, err := cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &ChannelBinding{Type: "tls-exporter", Data: data}, nil
+}
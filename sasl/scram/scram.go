@@ -0,0 +1,259 @@
+package saslscram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/mumuhhh/gohive2/sasl"
+)
+
+// ScramClient implements the SCRAM family of mechanisms (RFC 5802, RFC 7677). SCRAM
+// authenticates both parties but provides no security layer.
+type ScramClient struct {
+	mechanism       string
+	newHash         func() hash.Hash
+	authorizationID string
+	username        string
+	password        string
+	channelBinding  *ChannelBinding
+
+	step            int
+	completed       bool
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newScramClient(mechanism string, newHash func() hash.Hash, authorizationID, username, password string) *ScramClient {
+	return &ScramClient{
+		mechanism:       mechanism,
+		newHash:         newHash,
+		authorizationID: authorizationID,
+		username:        username,
+		password:        password,
+	}
+}
+
+func NewScramSHA1Client(authorizationID, username, password string) *ScramClient {
+	return newScramClient("SCRAM-SHA-1", sha1.New, authorizationID, username, password)
+}
+
+func NewScramSHA256Client(authorizationID, username, password string) *ScramClient {
+	return newScramClient("SCRAM-SHA-256", sha256.New, authorizationID, username, password)
+}
+
+func NewScramSHA512Client(authorizationID, username, password string) *ScramClient {
+	return newScramClient("SCRAM-SHA-512", sha512.New, authorizationID, username, password)
+}
+
+// SetChannelBinding binds the authentication to the TLS channel it runs over, which
+// selects the -PLUS variant of the mechanism. It must be called before the exchange starts.
+func (p *ScramClient) SetChannelBinding(cb *ChannelBinding) {
+	p.channelBinding = cb
+}
+
+func (p *ScramClient) GetMechanismName() string {
+	if p.channelBinding != nil {
+		return p.mechanism + "-PLUS"
+	}
+	return p.mechanism
+}
+
+func (p *ScramClient) HasInitialResponse() bool {
+	return true
+}
+
+func (p *ScramClient) EvaluateChallenge(challenge []byte) ([]byte, error) {
+	if p.completed {
+		return nil, fmt.Errorf("%s authentication already completed", p.mechanism)
+	}
+	switch p.step {
+	case 0:
+		p.step++
+		return p.clientFirstMessage()
+	case 1:
+		p.step++
+		return p.clientFinalMessage(challenge)
+	default:
+		if err := p.verifyServerFinal(challenge); err != nil {
+			return nil, err
+		}
+		p.completed = true
+		return nil, nil
+	}
+}
+
+// gs2Header announces channel binding usage and the authorization identity.
+func (p *ScramClient) gs2Header() string {
+	flag := "n"
+	if p.channelBinding != nil {
+		flag = "p=" + p.channelBinding.Type
+	}
+	authzID := ""
+	if p.authorizationID != "" {
+		authzID = "a=" + escapeName(p.authorizationID)
+	}
+	return flag + "," + authzID + ","
+}
+
+func (p *ScramClient) clientFirstMessage() ([]byte, error) {
+	if p.clientNonce == "" {
+		nonce := make([]byte, 24)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		p.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	}
+	p.clientFirstBare = "n=" + escapeName(p.username) + ",r=" + p.clientNonce
+	return []byte(p.gs2Header() + p.clientFirstBare), nil
+}
+
+func (p *ScramClient) clientFinalMessage(serverFirst []byte) ([]byte, error) {
+	attrs, err := parseAttributes(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	if msg, ok := attrs['e']; ok {
+		return nil, fmt.Errorf("%s authentication failed: %s", p.mechanism, msg)
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, p.clientNonce) || len(nonce) == len(p.clientNonce) {
+		return nil, fmt.Errorf("%s: server nonce does not extend the client nonce", p.mechanism)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("%s: invalid salt in server challenge", p.mechanism)
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("%s: invalid iteration count in server challenge", p.mechanism)
+	}
+
+	cbind := []byte(p.gs2Header())
+	if p.channelBinding != nil {
+		cbind = append(cbind, p.channelBinding.Data...)
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+	authMessage := []byte(p.clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+
+	saltedPassword := p.hi([]byte(p.password), salt, iterations)
+	clientKey := p.hmac(saltedPassword, []byte("Client Key"))
+	storedKey := p.h(clientKey)
+	clientSignature := p.hmac(storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	serverKey := p.hmac(saltedPassword, []byte("Server Key"))
+	p.serverSignature = p.hmac(serverKey, authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (p *ScramClient) verifyServerFinal(serverFinal []byte) error {
+	attrs, err := parseAttributes(serverFinal)
+	if err != nil {
+		return err
+	}
+	if msg, ok := attrs['e']; ok {
+		return fmt.Errorf("%s authentication failed: %s", p.mechanism, msg)
+	}
+	verifier, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(verifier, p.serverSignature) {
+		return fmt.Errorf("%s: server signature did not match", p.mechanism)
+	}
+	return nil
+}
+
+func (p *ScramClient) h(b []byte) []byte {
+	hash := p.newHash()
+	hash.Write(b)
+	return hash.Sum(nil)
+}
+
+func (p *ScramClient) hmac(key, b []byte) []byte {
+	mac := hmac.New(p.newHash, key)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// hi is PBKDF2 with HMAC as the pseudorandom function and a single output block.
+func (p *ScramClient) hi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(p.newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func (p *ScramClient) IsComplete() bool {
+	return p.completed
+}
+
+func (p *ScramClient) Unwrap([]byte) ([]byte, error) {
+	if p.completed {
+		return nil, errors.New("SCRAM supports neither integrity nor privacy")
+	}
+	return nil, fmt.Errorf("%s authentication not completed", p.mechanism)
+}
+
+func (p *ScramClient) Wrap([]byte) ([]byte, error) {
+	if p.completed {
+		return nil, errors.New("SCRAM supports neither integrity nor privacy")
+	}
+	return nil, fmt.Errorf("%s authentication not completed", p.mechanism)
+}
+
+func (p *ScramClient) GetNegotiatedProperty(propName string) (string, error) {
+	if p.completed {
+		if propName == "sasl.qop" {
+			return sasl.QopAuthentication, nil
+		} else {
+			return "", nil
+		}
+	} else {
+		return "", fmt.Errorf("%s authentication not completed", p.mechanism)
+	}
+}
+
+func (p *ScramClient) Dispose() {
+	p.password = ""
+}
+
+var _ sasl.Client = (*ScramClient)(nil)
+
+// escapeName encodes a saslname, in which ',' and '=' are reserved.
+func escapeName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// parseAttributes splits a SCRAM message into its single letter attributes.
+func parseAttributes(msg []byte) (map[byte]string, error) {
+	attrs := map[byte]string{}
+	for _, field := range bytes.Split(msg, []byte(",")) {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, fmt.Errorf("invalid SCRAM message: %q", msg)
+		}
+		attrs[field[0]] = string(field[2:])
+	}
+	return attrs, nil
+}
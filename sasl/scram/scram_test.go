@@ -0,0 +1,151 @@
+package saslscram
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+type scramVector struct {
+	client      *ScramClient
+	clientNonce string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}
+
+func runVector(t *testing.T, v scramVector) {
+	t.Helper()
+	c := v.client
+	c.clientNonce = v.clientNonce
+
+	first, err := c.EvaluateChallenge(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != v.clientFirst {
+		t.Fatalf("client-first = %q, want %q", first, v.clientFirst)
+	}
+	final, err := c.EvaluateChallenge([]byte(v.serverFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(final) != v.clientFinal {
+		t.Fatalf("client-final = %q, want %q", final, v.clientFinal)
+	}
+	if c.IsComplete() {
+		t.Fatal("complete before server-final")
+	}
+	if _, err := c.EvaluateChallenge([]byte(v.serverFinal)); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsComplete() {
+		t.Fatal("not complete after server-final")
+	}
+	if qop, _ := c.GetNegotiatedProperty("sasl.qop"); qop != "auth" {
+		t.Errorf("qop = %q", qop)
+	}
+}
+
+// TestScramSHA1 uses the example exchange of RFC 5802 section 5.
+func TestScramSHA1(t *testing.T) {
+	runVector(t, scramVector{
+		client:      NewScramSHA1Client("", "user", "pencil"),
+		clientNonce: "fyko+d2lbbFgONRv9qkxdawL",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	})
+}
+
+// TestScramSHA256 uses the example exchange of RFC 7677 section 3.
+func TestScramSHA256(t *testing.T) {
+	runVector(t, scramVector{
+		client:      NewScramSHA256Client("", "user", "pencil"),
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	})
+}
+
+// TestScramSHA512 checks the exchange against a server computed independently, since
+// there is no published vector.
+func TestScramSHA512(t *testing.T) {
+	c := NewScramSHA512Client("admin", "us,er=", "pencil")
+	c.SetChannelBinding(&ChannelBinding{Type: "tls-server-end-point", Data: []byte{1, 2, 3}})
+	if c.GetMechanismName() != "SCRAM-SHA-512-PLUS" {
+		t.Errorf("mechanism = %q", c.GetMechanismName())
+	}
+	first, err := c.EvaluateChallenge(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(first), "p=tls-server-end-point,a=admin,n=us=2Cer=3D,r=") {
+		t.Fatalf("client-first = %q", first)
+	}
+	clientFirstBare := string(first)[strings.Index(string(first), "n=us"):]
+	serverFirst := "r=" + c.clientNonce + "srv,s=" + base64.StdEncoding.EncodeToString([]byte("salt")) + ",i=1000"
+	final, err := c.EvaluateChallenge([]byte(serverFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutProof := string(final)[:strings.Index(string(final), ",p=")]
+	cbind := base64.StdEncoding.EncodeToString(append([]byte("p=tls-server-end-point,a=admin,"), 1, 2, 3))
+	if withoutProof != "c="+cbind+",r="+c.clientNonce+"srv" {
+		t.Fatalf("client-final = %q", final)
+	}
+
+	// Verify the proof the way a server holding only StoredKey would.
+	salted := c.hi([]byte("pencil"), []byte("salt"), 1000)
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+	storedKey := sha512.Sum512(c.hmac(salted, []byte("Client Key")))
+	signature := c.hmac(storedKey[:], authMessage)
+	proof, _ := base64.StdEncoding.DecodeString(string(final)[len(withoutProof)+3:])
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	if got := sha512.Sum512(proof); !hmac.Equal(got[:], storedKey[:]) {
+		t.Fatal("client proof does not verify")
+	}
+
+	serverSignature := c.hmac(c.hmac(salted, []byte("Server Key")), authMessage)
+	if _, err := c.EvaluateChallenge([]byte("v=" + base64.StdEncoding.EncodeToString(serverSignature))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScramRejectsBadServer(t *testing.T) {
+	c := NewScramSHA256Client("", "user", "pencil")
+	c.clientNonce = "abc"
+	if _, err := c.EvaluateChallenge(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EvaluateChallenge([]byte("r=xyz,s=c2FsdA==,i=4096")); err == nil {
+		t.Error("server nonce not extending the client nonce should fail")
+	}
+
+	c = NewScramSHA256Client("", "user", "pencil")
+	c.clientNonce = "abc"
+	_, _ = c.EvaluateChallenge(nil)
+	if _, err := c.EvaluateChallenge([]byte("r=abcdef,s=c2FsdA==,i=4096")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EvaluateChallenge([]byte("v=AAAA")); err == nil {
+		t.Error("wrong server signature should fail")
+	}
+	if c.IsComplete() {
+		t.Error("client should not complete with a wrong server signature")
+	}
+
+	c = NewScramSHA256Client("", "user", "pencil")
+	_, _ = c.EvaluateChallenge(nil)
+	if _, err := c.EvaluateChallenge([]byte("e=unknown-user")); err == nil || !strings.Contains(err.Error(), "unknown-user") {
+		t.Errorf("server error not reported: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package sasl
+
+// Server is the server side of a SASL mechanism, the counterpart of Client.
+type Server interface {
+	GetMechanismName() string
+	EvaluateResponse(response []byte) ([]byte, error)
+	IsComplete() bool
+	GetAuthorizationID() string
+	Unwrap(incoming []byte) ([]byte, error)
+	Wrap(outgoing []byte) ([]byte, error)
+	GetNegotiatedProperty(propName string) (string, error)
+	Dispose()
+}
+
+// PasswordLookup returns the password of username, or an error when the user is unknown.
+type PasswordLookup func(username string) (string, error)